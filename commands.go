@@ -0,0 +1,239 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"config2consul/config"
+	"config2consul/injest"
+	"config2consul/log"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// Exit codes of the check command
+const (
+	exitNoDrift = 0
+	exitError   = 1
+	exitDrift   = 2
+)
+
+// commands maps a command name to its implementation. A command gets the
+// remaining positional arguments and returns the process exit code.
+var commands = map[string]func(args []string) int{
+	"apply":    applyCommand,
+	"check":    checkCommand,
+	"export":   exportCommand,
+	"plan":     planCommand,
+	"render":   renderCommand,
+	"validate": validateCommand,
+	"watch":    watchCommand,
+}
+
+var outPath string
+var layers layerPaths
+
+func init() {
+	flag.StringVar(&outPath, "out", "", "plan: save the plan to this file to be executed later by apply. export, render: write the rules into this directory. check: write the report to this file")
+	flag.Var(&layers, "layer", "rules directory or file to merge over the previous layers. Can be repeated")
+}
+
+// layerPaths collects the repeated -layer flags
+type layerPaths []string
+
+func (paths *layerPaths) String() string {
+	return strings.Join(*paths, ", ")
+}
+
+func (paths *layerPaths) Set(path string) error {
+	*paths = append(*paths, path)
+	return nil
+}
+
+// rulesPaths returns the -layer paths, or the path to the rules in args
+func rulesPaths(args []string) []string {
+	if len(layers) > 0 {
+		if len(args) > 0 {
+			log.Fatal("Pass either the path to the rules or -layer paths, not both")
+		}
+		return layers
+	}
+	if len(args) == 0 {
+		log.Fatal("Missing path to the ACLs file")
+	}
+	return args[:1]
+}
+
+// applyCommand converges Consul to the rules or executes a saved plan.
+// This is the default command.
+func applyCommand(args []string) int {
+	if len(layers) == 0 && len(args) == 0 {
+		log.Fatal("Missing path to the ACLs file")
+	}
+	log.Info("Connecting to Consul at: " + config.Conf.Address)
+
+	if len(layers) == 0 && injest.IsPlanFile(args[0]) {
+		log.Info("Applying plan from " + args[0])
+		changes, err := injest.LoadPlan(args[0])
+		if err != nil {
+			log.Error(err)
+			return 1
+		}
+		changes.Print(os.Stdout)
+		if err := injest.ApplyPlan(changes); err != nil {
+			log.Error(err)
+			return 1
+		}
+		return 0
+	}
+
+	paths := rulesPaths(args)
+	log.Info("Applying ACLs from " + strings.Join(paths, ", "))
+	if err := injest.ImportConfig(injest.ImportLayers(paths)); err != nil {
+		log.Error(err)
+		return 1
+	}
+	return 0
+}
+
+// planCommand prints the changes apply would make without touching Consul
+func planCommand(args []string) int {
+	paths := rulesPaths(args)
+	log.Info("Connecting to Consul at: " + config.Conf.Address)
+	log.Info("Planning ACLs from " + strings.Join(paths, ", "))
+
+	changes, err := injest.PlanConfig(injest.ImportLayers(paths))
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	changes.Print(os.Stdout)
+
+	if outPath != "" {
+		if err := changes.Save(outPath); err != nil {
+			log.Error(err)
+			return 1
+		}
+		fmt.Printf("\nPlan saved to %s. To execute it run: config2consul apply %s\n", outPath, outPath)
+	}
+	return 0
+}
+
+// exportCommand writes the live state of Consul as rules
+func exportCommand(args []string) int {
+	log.Info("Connecting to Consul at: " + config.Conf.Address)
+
+	exported, err := injest.ExportConfig()
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	if err := exported.WriteRules(outPath, os.Stdout); err != nil {
+		log.Error(err)
+		return 1
+	}
+	return 0
+}
+
+// checkCommand reports the deviations of Consul from the rules as JSON without
+// writing anything to Consul. Exits with exitDrift if there are any.
+func checkCommand(args []string) int {
+	paths := rulesPaths(args)
+	log.Info("Connecting to Consul at: " + config.Conf.Address)
+	log.Info("Checking ACLs from " + strings.Join(paths, ", "))
+
+	changes, err := injest.PlanConfig(injest.ImportLayers(paths))
+	if err != nil {
+		log.Error(err)
+		return exitError
+	}
+
+	report := changes.DriftReport(config.Conf.Address)
+	out := os.Stdout
+	if outPath != "" {
+		if out, err = os.Create(outPath); err != nil {
+			log.Error(err)
+			return exitError
+		}
+		defer out.Close()
+	}
+	if err := report.Write(out); err != nil {
+		log.Error(err)
+		return exitError
+	}
+
+	if changes.HasChanges() {
+		log.Warning("Consul deviates from the rules")
+		return exitDrift
+	}
+	return exitNoDrift
+}
+
+// watchCommand keeps Consul converged to the rules until SIGTERM or SIGINT
+func watchCommand(args []string) int {
+	paths := rulesPaths(args)
+	log.Info("Connecting to Consul at: " + config.Conf.Address)
+	log.Info("Watching ACLs from " + strings.Join(paths, ", "))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	stop := make(chan struct{})
+	go func() {
+		sig := <-signals
+		log.Infof("Received %s, shutting down", sig)
+		close(stop)
+	}()
+
+	if err := injest.Watch(injest.ImportLayers(paths), os.Stdout, stop); err != nil {
+		log.Error(err)
+		return 1
+	}
+	return 0
+}
+
+// renderCommand prints the effective rules after merging the layers, without
+// connecting to Consul
+func renderCommand(args []string) int {
+	rules := injest.ImportLayers(rulesPaths(args))
+	if err := rules.WriteRules(outPath, os.Stdout); err != nil {
+		log.Error(err)
+		return 1
+	}
+	return 0
+}
+
+// validateCommand checks the rule files without connecting to Consul and
+// reports every problem found
+func validateCommand(args []string) int {
+	problems, err := injest.ValidateRules(rulesPaths(args))
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("\nFound %d problem(s)\n", len(problems))
+		return 1
+	}
+	fmt.Println("The rules are valid")
+	return 0
+}
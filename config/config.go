@@ -21,7 +21,10 @@ import (
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"strings"
 )
 
 // Config represents the configuration information.
@@ -36,10 +39,53 @@ type Config struct {
 	CertFile string `json:"cert_file,omitempty"`
 	KeyFile  string `json:"key_file,omitempty"`
 
+	// ProtectedAcls are the legacy ACLs which are never deleted, although
+	// they are not in the rules. The master token is always protected.
+	ProtectedAcls []ProtectedAcl `json:"protected_acls,omitempty"`
+
+	// Deprecated: protect the built-in tokens and the "Vault " ACLs with
+	// ProtectedAcls
 	PreserveBuiltInTokens bool `json:"preserve_builtin_tokens,omitempty"`
 	PreserveVaultACLs     bool `json:"preserve_vault_acls,omitempty"`
 
-	PreserveExistingKV bool `json:"preserve_vault_acls,omitempty"`
+	PreserveExistingKV bool `json:"preserve_existing_kv,omitempty"`
+
+	// Glob patterns of the rule files loaded from a rules directory and its
+	// subdirectories. *.yml and *.yaml files are loaded by default.
+	IncludeFiles []string `json:"include_files,omitempty"`
+	ExcludeFiles []string `json:"exclude_files,omitempty"`
+
+	// ManagedPrefixes limits KV convergence to these subtrees. The whole
+	// keyspace is managed if empty.
+	ManagedPrefixes []string `json:"managed_prefixes,omitempty"`
+
+	// Deletion safety limits. A run that deletes more keys or ACLs than
+	// allowed is aborted before writing anything. 0 disables a limit.
+	MaxDeletes       int     `json:"max_deletes,omitempty"`
+	MaxDeletePercent float64 `json:"max_delete_percent,omitempty"`
+	AllowMassDelete  bool    `json:"-"`
+
+	// WatchMode is what the watch command does with a deviation from the
+	// rules: "converge" (default) or "report"
+	WatchMode string `json:"watch_mode,omitempty"`
+
+	// LockKey is the key of the lock held while converging. Contenders wait
+	// for the lock if LockWait is set or skip the run otherwise.
+	LockKey  string `json:"lock_key,omitempty"`
+	LockWait bool   `json:"-"`
+
+	// Variables are the values of ${var.name} in the rules. The -var-file
+	// and -var flags override the variables of the config file.
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+// ProtectedAcl matches ACLs by their exact name, ID or name prefix. The
+// reason is logged whenever an ACL is protected.
+type ProtectedAcl struct {
+	Name   string `json:"name,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Reason string `json:"reason,omitempty"`
 }
 
 // Conf contains the initialized configuration struct
@@ -56,10 +102,30 @@ var Conf Config
 
 var configPath string
 var consulToken string
+var allowMassDelete bool
+var lockWait bool
+var variables stringList
+var variableFiles stringList
+
+// stringList collects the values of a repeated flag
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ", ")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
 
 func init() {
 	flag.StringVar(&configPath, "config", "./config.json", "path to the config file")
 	flag.StringVar(&consulToken, "token", "", "Consul token")
+	flag.BoolVar(&allowMassDelete, "allow-mass-delete", false, "apply even if the deletion safety limits are exceeded")
+	flag.BoolVar(&lockWait, "lock-wait", false, "wait for another config2consul instance to finish converging instead of skipping the run")
+	flag.Var(&variables, "var", "set a variable of the rules: name=value. Can be repeated")
+	flag.Var(&variableFiles, "var-file", "YAML file with variables of the rules. Can be repeated")
 }
 
 func ReadConfig() error {
@@ -75,7 +141,69 @@ func ReadConfig() error {
 	if (consulToken != "") {
 	    Conf.Token = consulToken
 	}
+	Conf.AllowMassDelete = allowMassDelete
+	Conf.LockWait = lockWait
+
+	for _, protected := range Conf.ProtectedAcls {
+		matchers := 0
+		for _, matcher := range []string{protected.Name, protected.ID, protected.Prefix} {
+			if matcher != "" {
+				matchers++
+			}
+		}
+		if matchers != 1 {
+			return fmt.Errorf("Protected ACL with reason '%s' must have exactly one of name, id or prefix", protected.Reason)
+		}
+	}
+	if err := CheckManagedPrefixes(Conf.ManagedPrefixes); err != nil {
+		return fmt.Errorf("%s: %v", configPath, err)
+	}
+
+	return readVariables()
+}
+
+// CheckManagedPrefixes makes sure every managed prefix ends with a '/', so
+// the prefix 'team-a/' doesn't own the keys of 'team-ab/'. The empty prefix
+// is the whole keyspace.
+func CheckManagedPrefixes(prefixes []string) error {
+	for _, prefix := range prefixes {
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			return fmt.Errorf("Managed prefix '%s' must end with a '/'", prefix)
+		}
+	}
+	return nil
+}
 
+// readVariables sets the variables of the -var-file and -var flags, in this
+// order, over the variables of the config file
+func readVariables() error {
+	if Conf.Variables == nil {
+		Conf.Variables = make(map[string]string)
+	}
+	for _, path := range variableFiles {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.New("Cant load variables file at path: " + path)
+		}
+		values := make(map[string]interface{})
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return fmt.Errorf("Failed to load variables file %s: %v", path, err)
+		}
+		for name, value := range values {
+			switch value.(type) {
+			case map[interface{}]interface{}, []interface{}:
+				return fmt.Errorf("Variable '%s' in %s is not a single value", name, path)
+			}
+			Conf.Variables[name] = fmt.Sprint(value)
+		}
+	}
+	for _, variable := range variables {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("Invalid variable '%s'. Expected -var name=value", variable)
+		}
+		Conf.Variables[parts[0]] = parts[1]
+	}
 	return nil
 }
 
@@ -18,7 +18,6 @@ package main
 
 import (
 	"config2consul/config"
-	"config2consul/injest"
 	"config2consul/log"
 	"flag"
 	"fmt"
@@ -42,18 +41,24 @@ func main() {
 		fmt.Println(version)
 		os.Exit(0)
 	}
+
+	// Commands take their own flags after the command name
+	args := flag.Args()
+	command := commands["apply"]
+	if len(args) > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			command = cmd
+			flag.CommandLine.Parse(args[1:])
+			args = flag.Args()
+		}
+	}
+
 	if err := config.ReadConfig(); err != nil {
 		fmt.Printf("%v\n", err)
 		os.Exit(-1)
 	}
 
 	log.Info("Starting config2consul v" + version)
-	log.Info("Connecting to Consul at: " + config.Conf.Address)
-
-	if len(flag.Args()) == 0 {
-		log.Fatal("Missing path to the ACLs file")
-	}
-	log.Info("Applying ACLs from " + flag.Args()[0])
 
-	injest.ImportConfig(injest.ImportPath(flag.Args()[0]))
+	os.Exit(command(args))
 }
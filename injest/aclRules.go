@@ -0,0 +1,179 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/hcl"
+	"sort"
+	"strings"
+)
+
+// scalarResources are the ACL rule resources declared with a single policy:
+// operator = "read"
+var scalarResources = map[string]bool{
+	"acl":      true,
+	"keyring":  true,
+	"mesh":     true,
+	"operator": true,
+	"peering":  true,
+}
+
+// blockResources are the ACL rule resources declared with a block per name:
+// key "app/" { policy = "read" }
+var blockResources = map[string]bool{
+	"agent": true, "agent_prefix": true,
+	"event": true, "event_prefix": true,
+	"identity": true, "identity_prefix": true,
+	"key": true, "key_prefix": true,
+	"node": true, "node_prefix": true,
+	"query": true, "query_prefix": true,
+	"service": true, "service_prefix": true,
+	"session": true, "session_prefix": true,
+}
+
+// scopeResources are the Enterprise resources which nest rules
+var scopeResources = map[string]bool{
+	"namespace": true, "namespace_prefix": true,
+	"partition": true, "partition_prefix": true,
+}
+
+var policyValues = map[string]bool{"read": true, "write": true, "deny": true, "list": true}
+
+// canonicalRules parses the HCL (or JSON) rules of an ACL and returns them in
+// a canonical form, so whitespace, comments, ordering and syntax style don't
+// count as changes. Fails on malformed rules, unknown resources and unknown
+// policy values.
+func canonicalRules(rules string) (string, error) {
+	if strings.TrimSpace(rules) == "" {
+		return "", nil
+	}
+	parsed := make(map[string]interface{})
+	if err := hcl.Decode(&parsed, rules); err != nil {
+		return "", fmt.Errorf("Malformed ACL rules. %v", err)
+	}
+	canonical, err := canonicalRuleSet(parsed, "")
+	if err != nil {
+		return "", err
+	}
+	encoded, err := json.Marshal(canonical)
+	return string(encoded), err
+}
+
+// sameRules reports whether two rules are semantically equal. Rules which
+// can't be parsed are compared as they are.
+func sameRules(a string, b string) bool {
+	canonicalA, errA := canonicalRules(a)
+	canonicalB, errB := canonicalRules(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return canonicalA == canonicalB
+}
+
+func canonicalRuleSet(parsed map[string]interface{}, scope string) (map[string]interface{}, error) {
+	canonical := make(map[string]interface{})
+	for resource, value := range parsed {
+		switch {
+		case resource == "policy" && scope != "":
+			policy, err := canonicalPolicy(value, scope)
+			if err != nil {
+				return nil, err
+			}
+			canonical[resource] = policy
+		case scalarResources[resource]:
+			policy, err := canonicalPolicy(value, resource)
+			if err != nil {
+				return nil, err
+			}
+			canonical[resource] = policy
+		case blockResources[resource], scopeResources[resource]:
+			if blocks(value) == nil {
+				return nil, fmt.Errorf("ACL rule resource '%s' must be declared as a block: %s \"name\" { policy = \"read\" }", resource, resource)
+			}
+			named := make(map[string]interface{})
+			for _, block := range blocks(value) {
+				for name, body := range block {
+					where := fmt.Sprintf("%s \"%s\"", resource, name)
+					attributes, err := canonicalBlock(resource, body, where)
+					if err != nil {
+						return nil, err
+					}
+					named[name] = attributes
+				}
+			}
+			canonical[resource] = named
+		default:
+			if scope != "" {
+				return nil, fmt.Errorf("Unknown ACL rule resource '%s' in %s", resource, scope)
+			}
+			return nil, fmt.Errorf("Unknown ACL rule resource '%s'", resource)
+		}
+	}
+	return canonical, nil
+}
+
+func canonicalBlock(resource string, body interface{}, where string) (map[string]interface{}, error) {
+	attributes := make(map[string]interface{})
+	for _, block := range blocks(body) {
+		for name, value := range block {
+			attributes[name] = value
+		}
+	}
+	if scopeResources[resource] {
+		return canonicalRuleSet(attributes, where)
+	}
+
+	canonical := make(map[string]interface{})
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name != "policy" && name != "intentions" {
+			return nil, fmt.Errorf("Unknown attribute '%s' in %s", name, where)
+		}
+		policy, err := canonicalPolicy(attributes[name], where)
+		if err != nil {
+			return nil, err
+		}
+		canonical[name] = policy
+	}
+	return canonical, nil
+}
+
+func canonicalPolicy(value interface{}, where string) (string, error) {
+	policy, ok := value.(string)
+	if !ok || !policyValues[policy] {
+		return "", fmt.Errorf("Invalid policy '%v' for %s. Expected read, write, deny or list", value, where)
+	}
+	return policy, nil
+}
+
+// blocks returns the objects HCL decodes a block, or repeated blocks, into
+func blocks(value interface{}) []map[string]interface{} {
+	switch value := value.(type) {
+	case []map[string]interface{}:
+		return value
+	case map[string]interface{}:
+		return []map[string]interface{}{value}
+	default:
+		return nil
+	}
+}
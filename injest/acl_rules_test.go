@@ -0,0 +1,121 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2consul/log"
+	consulapi "github.com/hashicorp/consul/api"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestAclRules(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	rules := `key "" {
+	policy = "read"
+}
+key "secret/" {
+	policy = "deny"
+}
+service "web" { policy = "write" intentions = "read" }
+operator = "read"
+`
+
+	Convey("Comparing ACL rules", t, func() {
+		Convey("Formatting, comments and ordering are not changes", func() {
+			reformatted := `# Operators may look around
+operator = "read"
+
+service "web" {
+  intentions = "read"
+  policy     = "write"
+}
+
+key "secret/" { policy = "deny" }
+key "" { policy = "read" }  // everything else
+`
+			So(sameRules(rules, reformatted), ShouldBeTrue)
+		})
+
+		Convey("JSON rules are the same as HCL rules", func() {
+			json := `{"key": {"": {"policy": "read"}, "secret/": {"policy": "deny"}}, "service": {"web": {"policy": "write", "intentions": "read"}}, "operator": "read"}`
+			So(sameRules(rules, json), ShouldBeTrue)
+		})
+
+		Convey("Semantic changes are changes", func() {
+			So(sameRules(rules, `key "" { policy = "read" }`), ShouldBeFalse)
+			So(sameRules(`key "" { policy = "read" }`, `key "" { policy = "write" }`), ShouldBeFalse)
+		})
+
+		Convey("An unchanged legacy ACL with reformatted rules is not updated", func() {
+			existing := &consulapi.ACLEntry{ID: "id", Name: "app", Type: "client", Rules: rules}
+			_, changed := planAcl(&acl{Name: "app", Type: "client", Rules: "operator = \"read\"\n" + `key "" { policy = "read" }
+key "secret/" { policy = "deny" }
+service "web" { policy = "write"
+  intentions = "read" }`}, existing)
+			So(changed, ShouldBeFalse)
+		})
+
+		Convey("Unparseable existing rules are compared as they are", func() {
+			So(sameRules("not { hcl", "not { hcl"), ShouldBeTrue)
+			So(sameRules("not { hcl", `key "" { policy = "read" }`), ShouldBeFalse)
+		})
+	})
+
+	Convey("Validating ACL rules", t, func() {
+		Convey("Empty rules are valid", func() {
+			_, err := canonicalRules("")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Malformed rules are rejected", func() {
+			_, err := canonicalRules(`key "" { policy = `)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "Malformed ACL rules")
+		})
+
+		Convey("Unknown resources are rejected", func() {
+			_, err := canonicalRules(`kye "" { policy = "read" }`)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Unknown ACL rule resource 'kye'")
+		})
+
+		Convey("Unknown policies are rejected", func() {
+			_, err := canonicalRules(`key "app/" { policy = "readwrite" }`)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `Invalid policy 'readwrite' for key "app/"`)
+
+			_, err = canonicalRules(`keyring = "admin"`)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Unknown attributes are rejected", func() {
+			_, err := canonicalRules(`key "app/" { polcy = "read" }`)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Unknown attribute 'polcy'")
+		})
+
+		Convey("Enterprise namespaces nest rules", func() {
+			_, err := canonicalRules(`namespace "team" {
+  policy = "read"
+  key_prefix "" { policy = "write" }
+}`)
+			So(err, ShouldBeNil)
+		})
+	})
+}
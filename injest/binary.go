@@ -0,0 +1,60 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// base64Reference is a binary value declared in base64: ${base64:data}
+var base64Reference = regexp.MustCompile(`^\$\{base64:([^}]*)\}$`)
+
+// decodeBase64Reference returns the raw bytes of the value if it is a
+// ${base64:data} reference, or the value itself otherwise. Whitespace in the
+// data is ignored, so long values can be folded.
+func decodeBase64Reference(value string, filename string, where string) (string, error) {
+	match := base64Reference.FindStringSubmatch(value)
+	if match == nil {
+		return value, nil
+	}
+	data := strings.Join(strings.Fields(match[1]), "")
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("Invalid base64 value of %s in %s. %v", where, filename, err)
+	}
+	return string(decoded), nil
+}
+
+// base64Value declares a value which isn't valid UTF-8 as ${base64:data}, so
+// it survives YAML and JSON
+func base64Value(value []byte) string {
+	return "${base64:" + base64.StdEncoding.EncodeToString(value) + "}"
+}
+
+// displayValue formats a value for the plan. Binary values are shown by size
+// and checksum.
+func displayValue(value string) string {
+	if utf8.ValidString(value) {
+		return fmt.Sprintf("%q", value)
+	}
+	return fmt.Sprintf("<binary, %d bytes, sha256 %x>", len(value), sha256.Sum256([]byte(value)))
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// aclDrift identifies an ACL which deviates from the rules. Kind is "legacy"
+// for the legacy ACLs, which are reported without an ID as their ID is the
+// token secret.
+type aclDrift struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	ID   string `json:"id,omitempty"`
+}
+
+// ignoredDrift is a deviation which is ignored on purpose. Kind is "kv" for
+// keys.
+type ignoredDrift struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// driftReport lists the deviations of Consul from the rules for security
+// monitoring. Values are never included in the report.
+type driftReport struct {
+	Time           time.Time      `json:"time"`
+	Address        string         `json:"address"`
+	Drift          bool           `json:"drift"`
+	UnexpectedAcls []aclDrift     `json:"unexpected_acls"`
+	ChangedAcls    []aclDrift     `json:"changed_acls"`
+	MissingAcls    []aclDrift     `json:"missing_acls"`
+	RunawayKeys    []string       `json:"runaway_keys"`
+	ChangedKeys    []string       `json:"changed_keys"`
+	MissingKeys    []string       `json:"missing_keys"`
+	Ignored        []ignoredDrift `json:"ignored"`
+
+	UnexpectedServices []string `json:"unexpected_services"`
+	ChangedServices    []string `json:"changed_services"`
+	MissingServices    []string `json:"missing_services"`
+}
+
+// DriftReport lists what a plan would change as deviations from the rules
+func (changes *plan) DriftReport(address string) *driftReport {
+	report := driftReport{
+		Time:           time.Now().UTC(),
+		Address:        address,
+		Drift:          changes.HasChanges(),
+		UnexpectedAcls: []aclDrift{},
+		ChangedAcls:    []aclDrift{},
+		MissingAcls:    []aclDrift{},
+		RunawayKeys:    []string{},
+		ChangedKeys:    []string{},
+		MissingKeys:    []string{},
+		Ignored:        []ignoredDrift{},
+
+		UnexpectedServices: []string{},
+		ChangedServices:    []string{},
+		MissingServices:    []string{},
+	}
+
+	addAcl := func(action string, drift aclDrift, reason string) {
+		switch action {
+		case actionCreate:
+			report.MissingAcls = append(report.MissingAcls, drift)
+		case actionUpdate:
+			report.ChangedAcls = append(report.ChangedAcls, drift)
+		case actionDelete:
+			report.UnexpectedAcls = append(report.UnexpectedAcls, drift)
+		case actionIgnore:
+			if reason != "" {
+				report.Ignored = append(report.Ignored, ignoredDrift{Kind: drift.Kind, Name: drift.Name, Reason: reason})
+			}
+		}
+	}
+	for _, change := range changes.Policies {
+		addAcl(change.Action, aclDrift{Kind: "legacy", Name: change.Name}, change.Reason)
+	}
+	for _, change := range changes.ACLObjects {
+		addAcl(change.Action, aclDrift{Kind: change.Kind, Name: change.Name, ID: change.ID}, change.Reason)
+	}
+
+	for _, change := range changes.KeyValues {
+		switch change.Action {
+		case actionCreate:
+			report.MissingKeys = append(report.MissingKeys, change.Key)
+		case actionUpdate:
+			report.ChangedKeys = append(report.ChangedKeys, change.Key)
+		case actionDelete:
+			report.RunawayKeys = append(report.RunawayKeys, change.Key)
+		case actionIgnore:
+			if change.Reason != "" {
+				report.Ignored = append(report.Ignored, ignoredDrift{Kind: "kv", Name: change.Key, Reason: change.Reason})
+			}
+		}
+	}
+
+	for _, change := range changes.Services {
+		label := serviceLabel(change.Node, change.ID)
+		switch change.Action {
+		case actionCreate:
+			report.MissingServices = append(report.MissingServices, label)
+		case actionUpdate:
+			report.ChangedServices = append(report.ChangedServices, label)
+		case actionDelete:
+			report.UnexpectedServices = append(report.UnexpectedServices, label)
+		}
+	}
+
+	return &report
+}
+
+// Write writes the report as JSON
+func (report *driftReport) Write(w io.Writer) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
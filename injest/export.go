@@ -0,0 +1,258 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2consul/config"
+	"config2consul/log"
+	consulapi "github.com/hashicorp/consul/api"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ExportConfig reads the live state of Consul into rules. A plan against the
+// exported rules has no changes.
+func ExportConfig() (*consulConfig, error) {
+	consul := create(&config.Conf)
+	exported, err := consul.exportConfig()
+	consul.Client = nil
+	return exported, err
+}
+
+func (consul *consulClient) exportConfig() (*consulConfig, error) {
+	exported := consulConfig{
+		Policies: acls{},
+		KeyValue: make(map[string]interface{}),
+	}
+
+	scope := exported.managedScope()
+	pairs, err := consul.getCurrentKVs(scope)
+	if err != nil {
+		return nil, err
+	}
+	exported.KeyValue = buildKVTree(pairs)
+	log.Infof("Exported %d keys", len(pairs))
+
+	q := consulapi.QueryOptions{}
+	legacyAcls, _, err := consul.Client.ACL().List(&q)
+	if err != nil {
+		log.Infof("Legacy ACLs are not available. %v", err)
+	} else {
+		for _, entry := range legacyAcls {
+			exported.Policies = append(exported.Policies, acl{Name: entry.Name, Type: entry.Type, Rules: entry.Rules})
+		}
+		sort.Slice(exported.Policies, func(i, j int) bool { return exported.Policies[i].Name < exported.Policies[j].Name })
+		log.Infof("Exported %d legacy ACLs", len(exported.Policies))
+	}
+
+	if err := consul.exportAclSystem(&exported); err != nil {
+		log.Infof("ACL policies, roles and tokens are not available. %v", err)
+	}
+
+	for _, section := range []interface{}{&exported.Policies, &exported.AclPolicies, &exported.AclRoles, &exported.AclTokens} {
+		escapeStrings(reflect.ValueOf(section).Elem())
+	}
+	return &exported, nil
+}
+
+func (consul *consulClient) exportAclSystem(exported *consulConfig) error {
+	q := consulapi.QueryOptions{}
+
+	policies, _, err := consul.Client.ACL().PolicyList(&q)
+	if err != nil {
+		return err
+	}
+	for _, entry := range policies {
+		if entry.ID == globalManagementPolicyID || strings.HasPrefix(entry.Name, "builtin/") {
+			continue
+		}
+		policy, _, err := consul.Client.ACL().PolicyRead(entry.ID, &q)
+		if err != nil {
+			return err
+		}
+		exported.AclPolicies = append(exported.AclPolicies, policyFromConsul(policy))
+	}
+	sort.Slice(exported.AclPolicies, func(i, j int) bool { return exported.AclPolicies[i].Name < exported.AclPolicies[j].Name })
+
+	roles, _, err := consul.Client.ACL().RoleList(&q)
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		exported.AclRoles = append(exported.AclRoles, normalizeRole(roleFromConsul(role)))
+	}
+	sort.Slice(exported.AclRoles, func(i, j int) bool { return exported.AclRoles[i].Name < exported.AclRoles[j].Name })
+
+	tokens, err := consul.listAclTokens(&q)
+	if err != nil {
+		return err
+	}
+	selfAccessorID := ""
+	if self, _, err := consul.Client.ACL().TokenReadSelf(&q); err == nil {
+		selfAccessorID = self.AccessorID
+	}
+	for _, entry := range tokens {
+		if entry.AccessorID == anonymousTokenAccessorID || entry.AccessorID == selfAccessorID || entry.AuthMethod != "" {
+			continue
+		}
+		token := tokenFromConsul(entry)
+		exported.AclTokens = append(exported.AclTokens, normalizeToken(token, token))
+	}
+	sort.Slice(exported.AclTokens, func(i, j int) bool { return exported.AclTokens[i].Description < exported.AclTokens[j].Description })
+
+	log.Infof("Exported %d ACL policies, %d roles and %d tokens", len(exported.AclPolicies), len(exported.AclRoles), len(exported.AclTokens))
+	return nil
+}
+
+// kvNode is a node of the tree of key path segments
+type kvNode struct {
+	// value is nil if the path is not a key
+	value    interface{}
+	children map[string]*kvNode
+}
+
+func (node *kvNode) child(name string) *kvNode {
+	if node.children == nil {
+		node.children = make(map[string]*kvNode)
+	}
+	if _, ok := node.children[name]; !ok {
+		node.children[name] = &kvNode{}
+	}
+	return node.children[name]
+}
+
+// buildKVTree nests the exported keys into trees. Values which aren't valid
+// UTF-8 are exported as ${base64:...}, keys with flags with the long form.
+// A ${ in a key or value is escaped, so it isn't resolved as a variable.
+func buildKVTree(pairs map[string]*consulapi.KVPair) map[string]interface{} {
+	values := make(map[string]interface{})
+	for key, pair := range pairs {
+		if strings.HasSuffix(key, "/") && (len(pair.Value) > 0 || pair.Flags != 0) {
+			log.Warningf("Can't export folder key '%s' with a value or flags. Add it to the rules manually.", key)
+			continue
+		}
+		var value interface{} = escape(string(pair.Value))
+		if !utf8.Valid(pair.Value) {
+			value = base64Value(pair.Value)
+		}
+		if pair.Flags != 0 {
+			value = flaggedValue{value: value, flags: pair.Flags}
+		}
+		values[escape(key)] = value
+	}
+	return nestKV(values)
+}
+
+// nestKV nests the values into trees ending with a '/'. A key which is also
+// the parent of other keys can't be nested in the same tree, so its children
+// are emitted as a separate top level tree. A key ending with a '/' is
+// declared with an empty child name inside its tree.
+func nestKV(values map[string]interface{}) map[string]interface{} {
+	root := kvNode{}
+	for key, value := range values {
+		node := &root
+		for _, segment := range strings.Split(key, "/") {
+			node = node.child(segment)
+		}
+		node.value = value
+	}
+
+	result := make(map[string]interface{})
+	for name, node := range root.children {
+		if node.value != nil {
+			result[name] = node.value
+		}
+		if len(node.children) > 0 {
+			result[name+"/"] = emitKVTree(node, name+"/", result)
+		}
+	}
+	return result
+}
+
+func emitKVTree(node *kvNode, path string, topLevel map[string]interface{}) map[string]interface{} {
+	tree := make(map[string]interface{})
+	for name, child := range node.children {
+		switch {
+		case len(child.children) == 0:
+			tree[name] = child.value
+		case child.value == nil:
+			tree[name] = emitKVTree(child, path+name+"/", topLevel)
+		default:
+			tree[name] = child.value
+			topLevel[path+name+"/"] = emitKVTree(child, path+name+"/", topLevel)
+		}
+	}
+	return tree
+}
+
+// WriteRules writes the rules as YAML files into a directory: acls.yml and
+// kv.yml. The rules are written to w if the directory is empty.
+func (consConf *consulConfig) WriteRules(dir string, w io.Writer) error {
+	aclRules := consulConfig{
+		Policies:    consConf.Policies,
+		AclPolicies: consConf.AclPolicies,
+		AclRoles:    consConf.AclRoles,
+		AclTokens:   consConf.AclTokens,
+		Ignore:      ignoreRules{Acls: consConf.Ignore.Acls, Tokens: consConf.Ignore.Tokens},
+	}
+	kvRules := consulConfig{
+		KeyValue:        consConf.KeyValue,
+		ManagedPrefixes: consConf.ManagedPrefixes,
+		Ignore:          ignoreRules{KV: consConf.Ignore.KV},
+	}
+
+	files := []struct {
+		name  string
+		rules consulConfig
+	}{
+		{"acls.yml", aclRules},
+		{"kv.yml", kvRules},
+	}
+	if len(consConf.Services) > 0 {
+		files = append(files, struct {
+			name  string
+			rules consulConfig
+		}{"services.yml", consulConfig{Services: consConf.Services}})
+	}
+	for _, file := range files {
+		data, err := yaml.Marshal(&file.rules)
+		if err != nil {
+			return err
+		}
+		data = append([]byte("---\n"), data...)
+		if dir == "" {
+			w.Write(data)
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		path := filepath.Join(dir, file.name)
+		log.Info("Writing file: " + path)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"bytes"
+	"config2consul/log"
+	consulapi "github.com/hashicorp/consul/api"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportKV(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	pairs := func(values map[string]string) map[string]*consulapi.KVPair {
+		result := make(map[string]*consulapi.KVPair)
+		for key, value := range values {
+			result[key] = &consulapi.KVPair{Key: key, Value: []byte(value)}
+		}
+		return result
+	}
+
+	Convey("Exporting keys", t, func() {
+		values := map[string]string{
+			"top":              "level",
+			"app/name":         "app",
+			"app/db/host":      "localhost",
+			"app/db/port":      "5432",
+			"app/db":           "a key which is also a tree",
+			"app/empty/":       "",
+			"app/flag":         "true",
+			"app/multi/line":   "a\nb\n",
+			"app/spaces/":      "",
+			"app/spaces/inner": " padded ",
+		}
+
+		Convey("Keys are nested into trees", func() {
+			tree := buildKVTree(pairs(values))
+			So(tree["top"], ShouldEqual, "level")
+			So(tree["app/"].(map[string]interface{})["name"], ShouldEqual, "app")
+			So(tree["app/db/"].(map[string]interface{})["host"], ShouldEqual, "localhost")
+		})
+
+		Convey("A plan against the exported rules has no changes", func() {
+			data, err := yaml.Marshal(&consulConfig{KeyValue: buildKVTree(pairs(values))})
+			So(err, ShouldBeNil)
+
+			var rules consulConfig
+			So(yaml.Unmarshal(data, &rules), ShouldBeNil)
+
+			current := pairs(values)
+			changes := []kvChange{}
+			So(planTree(&rules.KeyValue, kvScope{""}, current, &changes), ShouldBeNil)
+			So(changes, ShouldBeEmpty)
+			So(current, ShouldBeEmpty)
+		})
+
+		Convey("Values which aren't UTF-8 are exported in base64", func() {
+			binary := map[string]*consulapi.KVPair{"keystore": {Key: "keystore", Value: []byte{0xca, 0xfe, 0x00, 0xff}}}
+			tree := buildKVTree(binary)
+			So(tree["keystore"], ShouldEqual, "${base64:yv4A/w==}")
+
+			dir := writeRules(map[string]string{"kv.yml": "kv:\n  keystore: ${base64:yv4A/w==}\n"})
+			defer os.RemoveAll(dir)
+			rules := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+			So(loadFile(filepath.Join(dir, "kv.yml"), &rules), ShouldBeNil)
+			changes := []kvChange{}
+			So(planTree(&rules.KeyValue, kvScope{""}, binary, &changes), ShouldBeNil)
+			So(changes, ShouldBeEmpty)
+		})
+
+		Convey("Variables and references in keys and values are escaped", func() {
+			templated := pairs(map[string]string{
+				"tf/main":          "name = \"${var.name}\" # $${raw}",
+				"tf/${env.HOME}":   "${file:x.pem}",
+				"tf/${base64:Cg}/": "",
+			})
+			data, err := yaml.Marshal(&consulConfig{KeyValue: buildKVTree(templated)})
+			So(err, ShouldBeNil)
+
+			dir := writeRules(map[string]string{"kv.yml": string(data)})
+			defer os.RemoveAll(dir)
+			rules := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+			So(loadFile(filepath.Join(dir, "kv.yml"), &rules), ShouldBeNil)
+			changes := []kvChange{}
+			So(planTree(&rules.KeyValue, kvScope{""}, templated, &changes), ShouldBeNil)
+			So(changes, ShouldBeEmpty)
+			So(templated, ShouldBeEmpty)
+		})
+
+		Convey("Rules are written as YAML", func() {
+			var out bytes.Buffer
+			exported := consulConfig{
+				Policies: acls{acl{Name: "test", Type: "client", Rules: "# test"}},
+				KeyValue: buildKVTree(pairs(values)),
+			}
+			So(exported.WriteRules("", &out), ShouldBeNil)
+			So(out.String(), ShouldContainSubstring, "policies:")
+			So(out.String(), ShouldContainSubstring, "kv:")
+		})
+	})
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// fileReference is a value read from a file: ${file:path}
+var fileReference = regexp.MustCompile(`^\$\{file:([^}]+)\}$`)
+
+// dirReference is a tree mirroring a directory: ${dir:path}
+var dirReference = regexp.MustCompile(`^\$\{dir:([^}]+)\}$`)
+
+// relativePath resolves a path referenced by a rule file relative to the
+// directory of the file
+func relativePath(filename string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(filename), path)
+}
+
+// readFileReference returns the content of the file if the value is a
+// ${file:path} reference, or the value itself otherwise
+func readFileReference(value string, filename string, where string) (string, error) {
+	match := fileReference.FindStringSubmatch(value)
+	if match == nil {
+		return value, nil
+	}
+	content, err := ioutil.ReadFile(relativePath(filename, match[1]))
+	if err != nil {
+		return "", fmt.Errorf("Can't read the value of %s in %s. %v", where, filename, err)
+	}
+	return string(content), nil
+}
+
+// readDirReference returns a tree with a key for every file of the directory
+// and its subdirectories if the value is a ${dir:path} reference. Hidden files
+// and directories are skipped.
+func readDirReference(value string, filename string, where string) (map[interface{}]interface{}, bool, error) {
+	match := dirReference.FindStringSubmatch(value)
+	if match == nil {
+		return nil, false, nil
+	}
+
+	root := relativePath(filename, match[1])
+	tree := make(map[interface{}]interface{})
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		segments := strings.Split(filepath.ToSlash(rel), "/")
+		node := tree
+		for _, segment := range segments[:len(segments)-1] {
+			child, ok := node[segment].(map[interface{}]interface{})
+			if !ok {
+				child = make(map[interface{}]interface{})
+				node[segment] = child
+			}
+			node = child
+		}
+		node[segments[len(segments)-1]] = string(content)
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("Can't mirror the directory of %s in %s. %v", where, filename, err)
+	}
+	return tree, true, nil
+}
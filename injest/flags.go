@@ -0,0 +1,106 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Keys of the long form of a value with flags:
+//
+//	schema:
+//	  ${value}: v2
+//	  ${flags}: 42
+//
+// The value can also be a structure wrapped in ${json}.
+const (
+	valueKey = "${value}"
+	flagsKey = "${flags}"
+)
+
+// flaggedValue is a KV value declared with the flags of the key. The value is
+// a string or a jsonValue.
+type flaggedValue struct {
+	value interface{}
+	flags uint64
+}
+
+// MarshalYAML writes the value back in its long form
+func (value flaggedValue) MarshalYAML() (interface{}, error) {
+	result := map[string]interface{}{flagsKey: value.flags}
+	if encoded, ok := value.value.(jsonValue); ok {
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(encoded), &decoded); err != nil {
+			return nil, err
+		}
+		result[jsonWrapper] = decoded
+	} else {
+		result[valueKey] = value.value
+	}
+	return result, nil
+}
+
+// isValueKey reports whether a key of a map declares a single value instead
+// of a tree
+func isValueKey(key string) bool {
+	return key == jsonWrapper || key == valueKey || key == flagsKey
+}
+
+// newFlaggedValue builds the long form of a value from the keys of its map
+func newFlaggedValue(tree map[string]interface{}, path string) (interface{}, error) {
+	for key := range tree {
+		if !isValueKey(key) {
+			return nil, fmt.Errorf("Key '%s' has other keys next to '%s'", path, flagsKey)
+		}
+	}
+	flags := uint64(0)
+	if declared, ok := tree[flagsKey]; ok {
+		parsed, err := strconv.ParseUint(fmt.Sprint(declared), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid flags of key '%s': %v. Expected an unsigned integer", path, declared)
+		}
+		flags = parsed
+	}
+
+	_, hasValue := tree[valueKey]
+	inner, hasJSON := tree[jsonWrapper]
+	switch {
+	case hasValue && hasJSON:
+		return nil, fmt.Errorf("Key '%s' has both '%s' and '%s'", path, valueKey, jsonWrapper)
+	case !hasValue && !hasJSON:
+		return nil, fmt.Errorf("Key '%s' has '%s' without a '%s'", path, flagsKey, valueKey)
+	case hasJSON:
+		encoded, err := newJSONValue(inner, path, 1)
+		return flaggedValue{value: encoded, flags: flags}, err
+	}
+	value, ok := get_string_value(tree[valueKey])
+	if !ok {
+		return nil, fmt.Errorf("Unexpected value for the key '%s': %T", path, tree[valueKey])
+	}
+	return flaggedValue{value: value, flags: flags}, nil
+}
+
+// splitFlags returns the value and the declared flags of a KV value. A value
+// declared without flags has none.
+func splitFlags(value interface{}) (interface{}, uint64) {
+	if flagged, ok := value.(flaggedValue); ok {
+		return flagged.value, flagged.flags
+	}
+	return value, 0
+}
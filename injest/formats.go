@@ -0,0 +1,119 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/BurntSushi/toml"
+	"github.com/hashicorp/hcl"
+	"gopkg.in/yaml.v2"
+	"path/filepath"
+	"strings"
+)
+
+// ruleDecoders decode the rule formats other than YAML by file extension
+var ruleDecoders = map[string]func(data []byte) (map[string]interface{}, error){
+	".json": decodeJSON,
+	".hcl":  decodeHCL,
+	".toml": decodeTOML,
+}
+
+// ruleExtensions are the extensions of all the supported rule formats
+var ruleExtensions = []string{".yml", ".yaml", ".json", ".hcl", ".toml"}
+
+// toYAML converts a rule file of another format into YAML, so every format is
+// decoded into consulConfig, and its KV trees, exactly like YAML. Returns
+// false if the file is already YAML.
+func toYAML(filename string, data []byte) ([]byte, bool, error) {
+	extension := filepath.Ext(strings.TrimSuffix(filename, templateSuffix))
+	decode, ok := ruleDecoders[extension]
+	if !ok {
+		return data, false, nil
+	}
+
+	rules, err := decode(data)
+	if err != nil {
+		return nil, false, err
+	}
+	converted, err := yaml.Marshal(rules)
+	return converted, true, err
+}
+
+func decodeJSON(data []byte) (map[string]interface{}, error) {
+	rules := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Keeps large integers from turning into floats
+	decoder.UseNumber()
+	err := decoder.Decode(&rules)
+	return rules, err
+}
+
+func decodeTOML(data []byte) (map[string]interface{}, error) {
+	rules := make(map[string]interface{})
+	_, err := toml.Decode(string(data), &rules)
+	return rules, err
+}
+
+func decodeHCL(data []byte) (map[string]interface{}, error) {
+	rules := make(map[string]interface{})
+	if err := hcl.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	if kv, ok := rules["kv"]; ok {
+		rules["kv"] = mergeBlocks(kv)
+	}
+	for section, fields := range hclMapFields {
+		entries, _ := rules[section].([]map[string]interface{})
+		for _, entry := range entries {
+			for _, field := range fields {
+				if value, ok := entry[field]; ok {
+					entry[field] = mergeBlocks(value)
+				}
+			}
+		}
+	}
+	return rules, nil
+}
+
+// hclMapFields are the map fields of the entries of a section, which HCL
+// decodes into lists of blocks like the KV trees
+var hclMapFields = map[string][]string{
+	"services": {"meta"},
+}
+
+// mergeBlocks turns the lists of objects HCL decodes blocks into back into
+// the nested objects of a KV tree
+func mergeBlocks(value interface{}) interface{} {
+	switch value := value.(type) {
+	case []map[string]interface{}:
+		merged := make(map[string]interface{})
+		for _, block := range value {
+			for key, item := range block {
+				merged[key] = mergeBlocks(item)
+			}
+		}
+		return merged
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = mergeBlocks(item)
+		}
+		return value
+	default:
+		return value
+	}
+}
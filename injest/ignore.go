@@ -0,0 +1,153 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2consul/log"
+	"fmt"
+	pathpkg "path"
+	"regexp"
+	"strings"
+)
+
+// regexPrefix marks an ignore pattern as a regular expression instead of a glob
+const regexPrefix = "regex:"
+
+// ignoreRules are the patterns of the keys, legacy ACL names and token
+// descriptions which are never created, updated or deleted
+type ignoreRules struct {
+	KV     []string `yaml:"kv,omitempty"`
+	Acls   []string `yaml:"acls,omitempty"`
+	Tokens []string `yaml:"tokens,omitempty"`
+}
+
+// ignorePattern is a compiled glob or regex ignore pattern
+type ignorePattern struct {
+	source string
+	regex  *regexp.Regexp
+}
+
+// matches reports whether the name matches the pattern. Globs match the whole
+// name, with '*' not matching a '/'.
+func (pattern *ignorePattern) matches(name string) bool {
+	if pattern.regex != nil {
+		return pattern.regex.MatchString(name)
+	}
+	matched, _ := pathpkg.Match(pattern.source, name)
+	return matched
+}
+
+// reason explains why an item is ignored
+func (pattern *ignorePattern) reason() string {
+	return fmt.Sprintf("matches ignore pattern %q", pattern.source)
+}
+
+type ignorePatterns []ignorePattern
+
+// match returns the first pattern matching the name, or nil
+func (patterns ignorePatterns) match(name string) *ignorePattern {
+	for i := range patterns {
+		if patterns[i].matches(name) {
+			return &patterns[i]
+		}
+	}
+	return nil
+}
+
+func compilePatterns(section string, sources []string) (ignorePatterns, error) {
+	patterns := ignorePatterns{}
+	for _, source := range sources {
+		pattern := ignorePattern{source: source}
+		if strings.HasPrefix(source, regexPrefix) {
+			regex, err := regexp.Compile(strings.TrimPrefix(source, regexPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid ignore pattern '%s' of %s. %v", source, section, err)
+			}
+			pattern.regex = regex
+		} else if _, err := pathpkg.Match(source, ""); err != nil {
+			return nil, fmt.Errorf("Invalid ignore pattern '%s' of %s. %v", source, section, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// compiledIgnore are the compiled patterns of every section of ignoreRules
+type compiledIgnore struct {
+	kv     ignorePatterns
+	acls   ignorePatterns
+	tokens ignorePatterns
+}
+
+func (rules *ignoreRules) compile() (*compiledIgnore, error) {
+	var compiled compiledIgnore
+	var err error
+	if compiled.kv, err = compilePatterns("kv", rules.KV); err != nil {
+		return nil, err
+	}
+	if compiled.acls, err = compilePatterns("acls", rules.Acls); err != nil {
+		return nil, err
+	}
+	if compiled.tokens, err = compilePatterns("tokens", rules.Tokens); err != nil {
+		return nil, err
+	}
+	return &compiled, nil
+}
+
+func (rules *ignoreRules) merge(other ignoreRules) {
+	rules.KV = append(rules.KV, other.KV...)
+	rules.Acls = append(rules.Acls, other.Acls...)
+	rules.Tokens = append(rules.Tokens, other.Tokens...)
+}
+
+// applyIgnore turns the changes of the items matching an ignore pattern into
+// ignores, naming the pattern
+func (changes *plan) applyIgnore(rules *ignoreRules) error {
+	ignored, err := rules.compile()
+	if err != nil {
+		return err
+	}
+
+	for i, change := range changes.KeyValues {
+		if change.Action == actionIgnore {
+			continue
+		}
+		if pattern := ignored.kv.match(change.Key); pattern != nil {
+			log.Infof("Ignoring key '%s', it %s", change.Key, pattern.reason())
+			changes.KeyValues[i] = kvChange{Action: actionIgnore, Key: change.Key, Reason: pattern.reason()}
+		}
+	}
+	for i, change := range changes.Policies {
+		if change.Action == actionIgnore {
+			continue
+		}
+		if pattern := ignored.acls.match(change.Name); pattern != nil {
+			log.Infof("Ignoring ACL '%s', it %s", change.Name, pattern.reason())
+			changes.Policies[i] = aclChange{Action: actionIgnore, ID: change.ID, Name: change.Name, Reason: pattern.reason()}
+		}
+	}
+	for i, change := range changes.ACLObjects {
+		if change.Action == actionIgnore || change.Kind != aclKindToken {
+			continue
+		}
+		if pattern := ignored.tokens.match(change.Name); pattern != nil {
+			log.Infof("Ignoring ACL token '%s', it %s", change.Name, pattern.reason())
+			changes.ACLObjects[i] = aclObjectChange{Action: actionIgnore, Kind: change.Kind, ID: change.ID, Name: change.Name, Reason: pattern.reason()}
+		}
+	}
+	return nil
+}
@@ -19,13 +19,17 @@ package injest
 import (
 	"config2consul/config"
 	"config2consul/log"
+	"fmt"
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/hashicorp/go-cleanhttp"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"net/http"
 	"os"
+	pathpkg "path"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
 type consulClient struct {
@@ -42,8 +46,20 @@ type acl struct {
 type acls []acl
 
 type consulConfig struct {
-	Policies acls                   `yaml:"policies,omitempty"`
-	KeyValue map[string]interface{} `yaml:"kv,omitempty"`
+	Policies        acls                   `yaml:"policies,omitempty"`
+	AclPolicies     []aclPolicy            `yaml:"acl_policies,omitempty"`
+	AclRoles        []aclRole              `yaml:"acl_roles,omitempty"`
+	AclTokens       []aclToken             `yaml:"acl_tokens,omitempty"`
+	KeyValue        map[string]interface{} `yaml:"kv,omitempty"`
+	Services        []service              `yaml:"services,omitempty"`
+	ManagedPrefixes []string               `yaml:"managed_prefixes,omitempty"`
+	Ignore          ignoreRules            `yaml:"ignore,omitempty"`
+
+	// Override lets a file replace keys and ACLs defined by earlier files
+	Override bool `yaml:"override,omitempty"`
+
+	// sources is where every key and ACL of the merged rules is defined
+	sources ruleSources
 }
 
 func ImportPath(path string) *consulConfig {
@@ -54,16 +70,17 @@ func ImportPath(path string) *consulConfig {
 	}
 
 	filename, _ := filepath.Abs(path)
-	fileInfo, _ := os.Stat(filename)
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if fileInfo.IsDir() {
-		// TODO: read only files with *.yml extension
-		files, _ := ioutil.ReadDir(filename)
+		files, err := ruleFiles(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
 		for _, file := range files {
-			if file.IsDir() {
-				continue
-			}
-
-			ImportFile(filepath.Join(filename, file.Name()), &masterConfig)
+			ImportFile(file, &masterConfig)
 		}
 	} else {
 		ImportFile(path, &masterConfig)
@@ -72,56 +89,309 @@ func ImportPath(path string) *consulConfig {
 	return &masterConfig
 }
 
+// defaultIncludeFiles are the rule files of every format and their templates,
+// loaded from a directory unless the config file sets include_files
+var defaultIncludeFiles = func() []string {
+	patterns := []string{}
+	for _, extension := range ruleExtensions {
+		patterns = append(patterns, "*"+extension, "*"+extension+templateSuffix)
+	}
+	return patterns
+}()
+
+// ruleFiles lists the rule files in a directory and all of its subdirectories
+// in lexical order. Hidden files and directories are skipped.
+func ruleFiles(root string) ([]string, error) {
+	include := config.Conf.IncludeFiles
+	if len(include) == 0 {
+		include = defaultIncludeFiles
+	}
+
+	files := []string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if strings.HasPrefix(info.Name(), ".") || matchesAny(config.Conf.ExcludeFiles, rel) {
+			log.Debugf("Skipping %s", rel)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && matchesAny(include, rel) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// matchesAny reports whether a path relative to the rules directory matches
+// one of the glob patterns. A pattern without a '/' is matched against the
+// base name, otherwise against the whole relative path.
+func matchesAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = pathpkg.Base(rel)
+		}
+		if matched, _ := pathpkg.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
 func ImportFile(filename string, masterConfig *consulConfig) {
+	if err := loadFile(filename, masterConfig); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func loadFile(filename string, masterConfig *consulConfig) error {
 	log.Info("Loading file: " + filename)
-	yamlFile, err := ioutil.ReadFile(filename)
+	yamlFile, converted, err := readRules(filename)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	var config consulConfig
+	var rules consulConfig
 
-	err = yaml.Unmarshal(yamlFile, &config)
+	err = yaml.Unmarshal(yamlFile, &rules)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("%s: %v", describeRules(filename), err)
+	}
+	if err := resolveVariables(&rules, filename); err != nil {
+		return err
+	}
+	if err := rules.wrapValues(); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	if _, err := rules.Ignore.compile(); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	if err := config.CheckManagedPrefixes(rules.ManagedPrefixes); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	sources, err := locateDefinitions(filename, yamlFile, !converted)
+	if err != nil {
+		return err
 	}
 
-	masterConfig.mergeConfig(&config)
+	return masterConfig.mergeConfig(&rules, sources, filename)
 }
 
-func (masterConfig *consulConfig) mergeConfig(newConfig *consulConfig) {
-	(*masterConfig).Policies = append(masterConfig.Policies, newConfig.Policies...)
-	for k, v := range newConfig.KeyValue {
-		(*masterConfig).KeyValue[k] = v
+// readRules reads a rule file as YAML, rendering templates and converting
+// the other formats. Returns true if the file was converted to YAML.
+func readRules(filename string) ([]byte, bool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if strings.HasSuffix(filename, templateSuffix) {
+		if data, err = renderTemplate(filename, data); err != nil {
+			return nil, false, err
+		}
 	}
+
+	data, converted, err := toYAML(filename, data)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %v", filename, err)
+	}
+	return data, converted, nil
 }
 
-func ImportConfig(consConf *consulConfig) {
-	consul := create(&config.Conf)
-	importConfig(consul, consConf)
-	consul.Client = nil
+// describeRules names a rule file in errors about its decoded content
+func describeRules(filename string) string {
+	if strings.HasSuffix(filename, templateSuffix) {
+		return filename + " (rendered template)"
+	}
+	return filename
 }
 
-func importConfig(consul *consulClient, config *consulConfig) error {
-	if len(config.Policies) > 0 {
-		err := consul.importPolicies(&config.Policies)
-		if err != nil {
+// mergeConfig adds the rules of a file. A key or ACL defined by an earlier
+// file is a conflict, unless the file sets override.
+func (masterConfig *consulConfig) mergeConfig(newConfig *consulConfig, sources ruleSources, filename string) error {
+	override := newConfig.Override
+
+	for _, entry := range newConfig.Policies {
+		if err := masterConfig.claim(aclLabel(entry.Name), override, sources, filename); err != nil {
 			return err
 		}
-	} else {
-		log.Info("No ACLs to import.")
+		masterConfig.putPolicy(entry)
 	}
-	if len(config.KeyValue) > 0 {
-		err := consul.importKeyValue(&config.KeyValue)
-		if err != nil {
+	for _, entry := range newConfig.AclPolicies {
+		if err := masterConfig.claim(aclPolicyLabel(entry.Name), override, sources, filename); err != nil {
 			return err
 		}
-	} else {
-		log.Info("No KVs to import.")
+		masterConfig.putAclPolicy(entry)
+	}
+	for _, entry := range newConfig.AclRoles {
+		if err := masterConfig.claim(aclRoleLabel(entry.Name), override, sources, filename); err != nil {
+			return err
+		}
+		masterConfig.putAclRole(entry)
+	}
+	for _, entry := range newConfig.AclTokens {
+		if err := masterConfig.claim(aclTokenLabel(entry.AccessorID, entry.Description), override, sources, filename); err != nil {
+			return err
+		}
+		masterConfig.putAclToken(entry)
+	}
+	for _, entry := range newConfig.Services {
+		if err := masterConfig.claim(serviceLabel(entry.Node, entry.serviceID()), override, sources, filename); err != nil {
+			return err
+		}
+		masterConfig.putService(entry)
+	}
+
+	// Keys are claimed one by one, so trees of several files can share a prefix
+	merged, err := flattenKV(masterConfig.KeyValue)
+	if err != nil {
+		return err
+	}
+	keys, err := flattenKV(newConfig.KeyValue)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
 	}
+	for key, value := range keys {
+		if err := masterConfig.claim(kvLabel(key), override, sources, filename); err != nil {
+			return err
+		}
+		merged[key] = value
+	}
+	masterConfig.KeyValue = unflattenKV(merged)
+	masterConfig.ManagedPrefixes = append(masterConfig.ManagedPrefixes, newConfig.ManagedPrefixes...)
+	masterConfig.Ignore.merge(newConfig.Ignore)
 	return nil
 }
 
+// putPolicy replaces the legacy ACL with the same name, or adds it
+func (consConf *consulConfig) putPolicy(entry acl) {
+	for i := range consConf.Policies {
+		if consConf.Policies[i].Name == entry.Name {
+			consConf.Policies[i] = entry
+			return
+		}
+	}
+	consConf.Policies = append(consConf.Policies, entry)
+}
+
+// putAclPolicy replaces the ACL policy with the same name, or adds it
+func (consConf *consulConfig) putAclPolicy(entry aclPolicy) {
+	for i := range consConf.AclPolicies {
+		if consConf.AclPolicies[i].Name == entry.Name {
+			consConf.AclPolicies[i] = entry
+			return
+		}
+	}
+	consConf.AclPolicies = append(consConf.AclPolicies, entry)
+}
+
+// putAclRole replaces the ACL role with the same name, or adds it
+func (consConf *consulConfig) putAclRole(entry aclRole) {
+	for i := range consConf.AclRoles {
+		if consConf.AclRoles[i].Name == entry.Name {
+			consConf.AclRoles[i] = entry
+			return
+		}
+	}
+	consConf.AclRoles = append(consConf.AclRoles, entry)
+}
+
+// putAclToken replaces the ACL token with the same accessor ID, or the same
+// description if it has none, or adds it
+func (consConf *consulConfig) putAclToken(entry aclToken) {
+	label := aclTokenLabel(entry.AccessorID, entry.Description)
+	for i := range consConf.AclTokens {
+		if aclTokenLabel(consConf.AclTokens[i].AccessorID, consConf.AclTokens[i].Description) == label {
+			consConf.AclTokens[i] = entry
+			return
+		}
+	}
+	consConf.AclTokens = append(consConf.AclTokens, entry)
+}
+
+// putService replaces the service with the same ID on the same node, or adds
+// it
+func (consConf *consulConfig) putService(entry service) {
+	label := serviceLabel(entry.Node, entry.serviceID())
+	for i := range consConf.Services {
+		if serviceLabel(consConf.Services[i].Node, consConf.Services[i].serviceID()) == label {
+			consConf.Services[i] = entry
+			return
+		}
+	}
+	consConf.Services = append(consConf.Services, entry)
+}
+
+func ImportConfig(consConf *consulConfig) error {
+	consul := create(&config.Conf)
+	err := consul.withLock(nil, func() error {
+		return importConfig(consul, consConf)
+	})
+	consul.Client = nil
+	return err
+}
+
+// PlanConfig computes the changes required to converge Consul to the rules
+// without writing anything to Consul.
+func PlanConfig(consConf *consulConfig) (*plan, error) {
+	consul := create(&config.Conf)
+	changes, err := consul.planConfig(consConf)
+	consul.Client = nil
+	if err == nil {
+		if limitErr := changes.checkDeleteLimits(); limitErr != nil {
+			log.Warning(limitErr)
+		}
+	}
+	return changes, err
+}
+
+// ApplyPlan executes a saved plan. The plan is refused if anything it is
+// about to change was modified in Consul after the plan was created.
+func ApplyPlan(changes *plan) error {
+	consul := create(&config.Conf)
+	err := changes.checkDeleteLimits()
+	if err == nil {
+		err = consul.withLock(nil, func() error {
+			if err := consul.verifyPlan(changes); err != nil {
+				return err
+			}
+			return consul.applyPlan(changes)
+		})
+	}
+	consul.Client = nil
+	return err
+}
+
+func importConfig(consul *consulClient, config *consulConfig) error {
+	changes, err := consul.planConfig(config)
+	if err != nil {
+		return err
+	}
+	if err := changes.checkDeleteLimits(); err != nil {
+		return err
+	}
+	return consul.applyPlan(changes)
+}
+
 func create(config *config.Config) *consulClient {
 	consul := consulClient{}
 
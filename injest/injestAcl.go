@@ -17,53 +17,48 @@
 package injest
 
 import (
-	"config2consul/config"
 	"config2consul/log"
 	"errors"
 	"fmt"
 	consulapi "github.com/hashicorp/consul/api"
-	"strings"
+	"sort"
 )
 
-func (consul *consulClient) getCurrentAcls1() (*map[string]string, error) {
-	currentAcls := make(map[string]string)
+func (consul *consulClient) getCurrentAcls() (map[string]*consulapi.ACLEntry, error) {
+	currentAcls := make(map[string]*consulapi.ACLEntry)
 
 	q := consulapi.QueryOptions{}
-	aclEntry, _, err := consul.Client.ACL().List(&q)
+	aclEntries, _, err := consul.Client.ACL().List(&q)
 	if err != nil {
-		return &currentAcls, err
+		log.Errorf("Failed to list ACLs. %v", err)
+		return currentAcls, err
 	}
 
-	for _, acl := range aclEntry {
-		//if _, ok := currentAcls[acl.Name]; ok {
-		//	log.Warning("Found duplicate ACL name: " + acl.Name)
-		//}
-		currentAcls[acl.ID] = acl.Name
+	// Validate there are no duplicates in existing values
+	for _, entry := range aclEntries {
+		if _, ok := currentAcls[entry.Name]; ok {
+			err := fmt.Sprintf("Found existing Policies with name '%s'", entry.Name)
+			log.Error(err)
+			return currentAcls, errors.New(err)
+		}
+		currentAcls[entry.Name] = entry
+		log.Debugf("Found ACL %s", entry.Name)
 	}
 
-	return &currentAcls, nil
+	return currentAcls, nil
 }
 
-func (consul *consulClient) importPolicies(newACLs *acls) error {
-
-	currentAcls1, _ := consul.getCurrentAcls1()
-
+func (consul *consulClient) planPolicies(newACLs *acls, changes *plan) error {
 	// Do nothing if no ACLs were found
 	if len(*newACLs) == 0 {
 		return nil
 	}
 
-	// Validate there are no duplicates in existing values
-	uniqueValues := make(map[string]string)
-	for id, name := range *currentAcls1 {
-		if id2, ok := uniqueValues[name]; ok {
-			err := fmt.Sprintf("Found existing Policies with name '%s'. ids: (%s, %s)", name, id, id2)
-			log.Errorf(err)
-			return errors.New(err)
-		}
-		uniqueValues[name] = id
-		log.Debugf("Found ACL %s:%s", id, name)
+	currentAcls, err := consul.getCurrentAcls()
+	if err != nil {
+		return err
 	}
+	changes.ManagedAcls = len(currentAcls)
 
 	// Validate there are no duplicates in porovided values
 	newACLmap := make(map[string]acl)
@@ -72,99 +67,140 @@ func (consul *consulClient) importPolicies(newACLs *acls) error {
 			log.Errorf("Found duplicate ACL ID '%s' in the injest. Aborting ...", acl.Name)
 			return errors.New("Found duplicate ACL ID '" + acl.Name + "' in the injest.")
 		}
-		newACLmap[acl.Name] = acl
-	}
-
-	// Injest ACLs
-	for _, acl := range *newACLs {
-		done, _ := consul.applyAcl(&acl, &uniqueValues)
-		if done {
-			delete(uniqueValues, acl.Name)
+		if acl.Rules != "${ignore}" {
+			if _, err := canonicalRules(acl.Rules); err != nil {
+				log.Errorf("Invalid rules of ACL '%s'. %v", acl.Name, err)
+				return fmt.Errorf("Invalid rules of ACL '%s'. %v", acl.Name, err)
+			}
 		}
+		newACLmap[acl.Name] = acl
 	}
 
-	if config.Conf.PreserveBuiltInTokens {
-		log.Info("Preserving Master and Anonymous Token")
-		delete(uniqueValues, "Master Token")
-		delete(uniqueValues, "Anonymous Token")
+	names := make([]string, 0, len(newACLmap))
+	for name := range newACLmap {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	// TODO: add ${ignore} rules for ACLs prefixes
-	if config.Conf.PreserveVaultACLs {
-		keys_to_save := []string{}
-		for key := range uniqueValues {
-			if strings.HasPrefix(key, "Vault ") {
-				keys_to_save = append(keys_to_save, key)
-				log.Info("Preserving Vault ACL: " + key)
-				delete(uniqueValues, key)
-			}
+	// Injest ACLs
+	for _, name := range names {
+		acl := newACLmap[name]
+		if change, ok := planAcl(&acl, currentAcls[name]); ok {
+			changes.Policies = append(changes.Policies, change)
 		}
-		keys_to_save = nil
+		delete(currentAcls, name)
 	}
 
 	// Purging the rest of the values
-	for name, id := range uniqueValues {
-		if name == "Master Token" {
-			log.Info("Leaving Master Token intact.")
+	unexpected := make([]string, 0, len(currentAcls))
+	for name := range currentAcls {
+		unexpected = append(unexpected, name)
+	}
+	sort.Strings(unexpected)
+
+	protected := protectedAcls()
+	for _, name := range unexpected {
+		existing := currentAcls[name]
+		if protection := findProtection(protected, existing.ID, name); protection != nil {
+			log.Infof("Preserving ACL '%s'. %s", name, protection.Reason)
+			changes.Policies = append(changes.Policies, aclChange{Action: actionIgnore, ID: existing.ID, Name: name, Reason: protectionReason(protection)})
 			continue
 		}
-		log.Warningf("Deleting unexpected ACL '%s' with ID: %s", name, id)
-		consul.deleteAcl(id)
+		log.Warningf("Found unexpected ACL '%s'", name)
+		changes.Policies = append(changes.Policies, aclChange{
+			Action:      actionDelete,
+			ID:          existing.ID,
+			Name:        name,
+			OldType:     existing.Type,
+			OldRules:    existing.Rules,
+			ModifyIndex: existing.ModifyIndex,
+		})
 	}
 
 	return nil
 }
 
-func (consul *consulClient) applyAcl(acl *acl, currentAcls *map[string]string) (bool, error) {
-	w := consulapi.WriteOptions{}
-
+// planAcl compares a declared ACL with the existing one (if any). Returns false
+// if nothing has to be done.
+func planAcl(acl *acl, existingAcl *consulapi.ACLEntry) (aclChange, bool) {
 	if acl.Rules == "${ignore}" {
 		log.Infof("Ignoring %s ACL", acl.Name)
-		return true, nil
+		change := aclChange{Action: actionIgnore, Name: acl.Name}
+		if existingAcl != nil {
+			change.ID = existingAcl.ID
+		}
+		return change, true
+	}
+
+	// Type is either client or management
+	aclType := acl.Type
+	if aclType == "" {
+		aclType = "client"
+	}
+
+	if existingAcl == nil {
+		log.Infof("ACL '%s' will be created", acl.Name)
+		return aclChange{
+			Action: actionCreate,
+			Name:   acl.Name,
+			Type:   aclType,
+			Rules:  acl.Rules,
+		}, true
 	}
 
-	if id, ok := (*currentAcls)[acl.Name]; ok {
-		q := consulapi.QueryOptions{}
-		// TODO: is it by the name or ID, or both?
-		existingAcl, _, err := consul.Client.ACL().Info(id, &q)
+	// Rules are compared semantically, formatting changes are not updates
+	if existingAcl.Type == aclType && sameRules(existingAcl.Rules, acl.Rules) {
+		log.Infof("Skipping ACL '%s'. Nothing to update.", acl.Name)
+		return aclChange{}, false
+	}
+
+	log.Infof("ACL '%s' will be updated", acl.Name)
+	return aclChange{
+		Action:      actionUpdate,
+		ID:          existingAcl.ID,
+		Name:        acl.Name,
+		Type:        aclType,
+		Rules:       acl.Rules,
+		OldType:     existingAcl.Type,
+		OldRules:    existingAcl.Rules,
+		ModifyIndex: existingAcl.ModifyIndex,
+	}, true
+}
+
+func (consul *consulClient) applyAclChange(change *aclChange) (bool, error) {
+	w := consulapi.WriteOptions{}
+
+	switch change.Action {
+	case actionCreate:
+		newAcl := consulapi.ACLEntry{
+			Name:  change.Name,
+			Type:  change.Type,
+			Rules: change.Rules,
+		}
+		_, _, err := consul.Client.ACL().Create(&newAcl, &w)
 		if err != nil {
-			log.Errorf("Failed to get info for ACL w/ID: %s. %v", id, err)
+			log.Errorf("Failed to create ACL w/Name: %s. %v", change.Name, err)
 			return false, err
 		}
-		if acl.Type == "" {
-			acl.Type = "client"
-		}
-		if existingAcl.Type == acl.Type && existingAcl.Rules == acl.Rules {
-			log.Infof("Skipping ACL '%s' with ID: %s. Nothing to update.", acl.Name, existingAcl.ID)
-			return true, nil
+		log.Infof("A new ACL '%s' has been created", change.Name)
+	case actionUpdate:
+		existingAcl := consulapi.ACLEntry{
+			ID:    change.ID,
+			Name:  change.Name,
+			Type:  change.Type,
+			Rules: change.Rules,
 		}
-		existingAcl.Rules = acl.Rules
-		existingAcl.Type = acl.Type
-		log.Infof("Updating ACL '%s' with ID: %s", acl.Name, existingAcl.ID)
-		_, err = consul.Client.ACL().Update(existingAcl, &w)
+		log.Infof("Updating ACL '%s'", change.Name)
+		_, err := consul.Client.ACL().Update(&existingAcl, &w)
 		if err != nil {
 			log.Errorf("Failed to update ACL. %v", err)
-			return false, errors.New("Failed to update ACL with Name: " + acl.Name)
+			return false, errors.New("Failed to update ACL with Name: " + change.Name)
 		}
-
-		return true, nil
+	case actionDelete:
+		log.Warningf("Deleting unexpected ACL '%s'", change.Name)
+		return consul.deleteAcl(change.ID)
 	}
 
-	newAcl := consulapi.ACLEntry{
-		Name: acl.Name,
-		// Type is either client or management
-		Type:  "client",
-		Rules: acl.Rules,
-	}
-	if acl.Type != "" {
-		newAcl.Type = acl.Type
-	}
-	id, _, err := consul.Client.ACL().Create(&newAcl, &w)
-	if err != nil {
-		log.Errorf("Failed to create ACL w/Name: %s. %v", acl.Name, err)
-		return false, err
-	}
-	log.Infof("A new ACL '%s' has been created with ID: %s", acl.Name, id)
 	return true, nil
 }
 
@@ -172,7 +208,7 @@ func (consul *consulClient) deleteAcl(id string) (bool, error) {
 	w := consulapi.WriteOptions{}
 	_, err := consul.Client.ACL().Destroy(id, &w)
 	if err != nil {
-		log.Errorf("Failed to delete ACL w/ID: %s. %v", id, err)
+		log.Errorf("Failed to delete ACL. %v", err)
 		return false, err
 	}
 	return true, nil
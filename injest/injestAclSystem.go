@@ -0,0 +1,816 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+// Convergence of the ACL system introduced in Consul 1.4: policies, roles and
+// tokens. The legacy ACLs are handled in injestAcl.go.
+
+import (
+	"config2consul/log"
+	"fmt"
+	consulapi "github.com/hashicorp/consul/api"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of objects of the ACL system
+const (
+	aclKindPolicy = "policy"
+	aclKindRole   = "role"
+	aclKindToken  = "token"
+)
+
+// Built-in objects which are never updated or deleted
+const (
+	globalManagementPolicyID = "00000000-0000-0000-0000-000000000001"
+	anonymousTokenAccessorID = "00000000-0000-0000-0000-000000000002"
+)
+
+type serviceIdentity struct {
+	ServiceName string   `yaml:"service_name" json:"service_name"`
+	Datacenters []string `yaml:"datacenters,omitempty" json:"datacenters,omitempty"`
+}
+
+type nodeIdentity struct {
+	NodeName   string `yaml:"node_name" json:"node_name"`
+	Datacenter string `yaml:"datacenter" json:"datacenter"`
+}
+
+type aclPolicy struct {
+	Name        string   `yaml:"name" json:"name"`
+	Description string   `yaml:"description,omitempty" json:"description,omitempty"`
+	Rules       string   `yaml:"rules,omitempty" json:"rules,omitempty"`
+	Datacenters []string `yaml:"datacenters,omitempty" json:"datacenters,omitempty"`
+}
+
+type aclRole struct {
+	Name              string            `yaml:"name" json:"name"`
+	Description       string            `yaml:"description,omitempty" json:"description,omitempty"`
+	Policies          []string          `yaml:"policies,omitempty" json:"policies,omitempty"`
+	ServiceIdentities []serviceIdentity `yaml:"service_identities,omitempty" json:"service_identities,omitempty"`
+	NodeIdentities    []nodeIdentity    `yaml:"node_identities,omitempty" json:"node_identities,omitempty"`
+}
+
+// aclToken is identified by its accessor ID if declared, by its description
+// otherwise. The expiration is only applied when the token is created.
+type aclToken struct {
+	AccessorID        string            `yaml:"accessor_id,omitempty" json:"accessor_id,omitempty"`
+	SecretID          string            `yaml:"secret_id,omitempty" json:"secret_id,omitempty"`
+	Description       string            `yaml:"description" json:"description"`
+	Policies          []string          `yaml:"policies,omitempty" json:"policies,omitempty"`
+	Roles             []string          `yaml:"roles,omitempty" json:"roles,omitempty"`
+	ServiceIdentities []serviceIdentity `yaml:"service_identities,omitempty" json:"service_identities,omitempty"`
+	NodeIdentities    []nodeIdentity    `yaml:"node_identities,omitempty" json:"node_identities,omitempty"`
+	Local             bool              `yaml:"local,omitempty" json:"local,omitempty"`
+	ExpirationTTL     string            `yaml:"expiration_ttl,omitempty" json:"expiration_ttl,omitempty"`
+	ExpirationTime    string            `yaml:"expiration_time,omitempty" json:"expiration_time,omitempty"`
+}
+
+// aclObjectChange is a change of a policy, role or token. Old holds the
+// description of the existing object for the review of the plan.
+type aclObjectChange struct {
+	Action      string     `json:"action"`
+	Kind        string     `json:"kind"`
+	ID          string     `json:"id,omitempty"`
+	Name        string     `json:"name"`
+	Policy      *aclPolicy `json:"policy,omitempty"`
+	Role        *aclRole   `json:"role,omitempty"`
+	Token       *aclToken  `json:"token,omitempty"`
+	Old         []string   `json:"old,omitempty"`
+	ModifyIndex uint64     `json:"modify_index,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+}
+
+// planAclSystem plans policies, roles and tokens. Objects are created and
+// updated in dependency order (policies, roles, tokens) and deleted in reverse.
+// A kind of objects is only converged if the rules declare at least one of them.
+func (consul *consulClient) planAclSystem(config *consulConfig, changes *plan) error {
+	upserts := []aclObjectChange{}
+	deletes := []aclObjectChange{}
+
+	if len(config.AclPolicies) > 0 {
+		policyUpserts, policyDeletes, err := consul.planAclPolicies(config.AclPolicies, changes)
+		if err != nil {
+			return err
+		}
+		upserts = append(upserts, policyUpserts...)
+		deletes = append(policyDeletes, deletes...)
+	}
+	if len(config.AclRoles) > 0 {
+		roleUpserts, roleDeletes, err := consul.planAclRoles(config.AclRoles, changes)
+		if err != nil {
+			return err
+		}
+		upserts = append(upserts, roleUpserts...)
+		deletes = append(roleDeletes, deletes...)
+	}
+	if len(config.AclTokens) > 0 {
+		tokenUpserts, tokenDeletes, err := consul.planAclTokens(config.AclTokens, changes)
+		if err != nil {
+			return err
+		}
+		upserts = append(upserts, tokenUpserts...)
+		deletes = append(tokenDeletes, deletes...)
+	}
+
+	changes.ACLObjects = append(upserts, deletes...)
+	return nil
+}
+
+func (consul *consulClient) planAclPolicies(newPolicies []aclPolicy, changes *plan) ([]aclObjectChange, []aclObjectChange, error) {
+	q := consulapi.QueryOptions{}
+	entries, _, err := consul.Client.ACL().PolicyList(&q)
+	if err != nil {
+		log.Errorf("Failed to list ACL policies. %v", err)
+		return nil, nil, err
+	}
+	changes.ManagedAcls += len(entries)
+
+	current := make(map[string]*consulapi.ACLPolicyListEntry)
+	for _, entry := range entries {
+		current[entry.Name] = entry
+	}
+
+	declared := make(map[string]bool)
+	upserts := []aclObjectChange{}
+	for i := range newPolicies {
+		policy := newPolicies[i]
+		if declared[policy.Name] {
+			return nil, nil, fmt.Errorf("Found duplicate ACL policy '%s' in the injest.", policy.Name)
+		}
+		declared[policy.Name] = true
+
+		if policy.Rules == "${ignore}" {
+			log.Infof("Ignoring ACL policy %s", policy.Name)
+			upserts = append(upserts, aclObjectChange{Action: actionIgnore, Kind: aclKindPolicy, Name: policy.Name})
+			continue
+		}
+
+		if _, err := canonicalRules(policy.Rules); err != nil {
+			log.Errorf("Invalid rules of ACL policy '%s'. %v", policy.Name, err)
+			return nil, nil, fmt.Errorf("Invalid rules of ACL policy '%s'. %v", policy.Name, err)
+		}
+
+		entry, ok := current[policy.Name]
+		if !ok {
+			upserts = append(upserts, aclObjectChange{Action: actionCreate, Kind: aclKindPolicy, Name: policy.Name, Policy: &policy})
+			continue
+		}
+
+		existing, _, err := consul.Client.ACL().PolicyRead(entry.ID, &q)
+		if err != nil {
+			log.Errorf("Failed to read ACL policy '%s'. %v", policy.Name, err)
+			return nil, nil, err
+		}
+		old := policyFromConsul(existing)
+		if reflect.DeepEqual(normalizePolicy(policy), normalizePolicy(old)) {
+			log.Infof("Skipping ACL policy '%s'. Nothing to update.", policy.Name)
+			continue
+		}
+		upserts = append(upserts, aclObjectChange{
+			Action:      actionUpdate,
+			Kind:        aclKindPolicy,
+			ID:          existing.ID,
+			Name:        policy.Name,
+			Policy:      &policy,
+			Old:         old.describe(),
+			ModifyIndex: existing.ModifyIndex,
+		})
+	}
+
+	deletes := []aclObjectChange{}
+	for _, entry := range entries {
+		if declared[entry.Name] {
+			continue
+		}
+		if entry.ID == globalManagementPolicyID || strings.HasPrefix(entry.Name, "builtin/") {
+			deletes = append(deletes, aclObjectChange{Action: actionIgnore, Kind: aclKindPolicy, ID: entry.ID, Name: entry.Name})
+			continue
+		}
+		log.Warningf("Found unexpected ACL policy '%s' with ID: %s", entry.Name, entry.ID)
+		deletes = append(deletes, aclObjectChange{
+			Action:      actionDelete,
+			Kind:        aclKindPolicy,
+			ID:          entry.ID,
+			Name:        entry.Name,
+			ModifyIndex: entry.ModifyIndex,
+		})
+	}
+	sort.Slice(deletes, func(i, j int) bool { return deletes[i].Name < deletes[j].Name })
+
+	return upserts, deletes, nil
+}
+
+func (consul *consulClient) planAclRoles(newRoles []aclRole, changes *plan) ([]aclObjectChange, []aclObjectChange, error) {
+	q := consulapi.QueryOptions{}
+	roles, _, err := consul.Client.ACL().RoleList(&q)
+	if err != nil {
+		log.Errorf("Failed to list ACL roles. %v", err)
+		return nil, nil, err
+	}
+	changes.ManagedAcls += len(roles)
+
+	current := make(map[string]*consulapi.ACLRole)
+	for _, role := range roles {
+		current[role.Name] = role
+	}
+
+	declared := make(map[string]bool)
+	upserts := []aclObjectChange{}
+	for i := range newRoles {
+		role := newRoles[i]
+		if declared[role.Name] {
+			return nil, nil, fmt.Errorf("Found duplicate ACL role '%s' in the injest.", role.Name)
+		}
+		declared[role.Name] = true
+
+		existing, ok := current[role.Name]
+		if !ok {
+			upserts = append(upserts, aclObjectChange{Action: actionCreate, Kind: aclKindRole, Name: role.Name, Role: &role})
+			continue
+		}
+
+		old := roleFromConsul(existing)
+		if reflect.DeepEqual(normalizeRole(role), normalizeRole(old)) {
+			log.Infof("Skipping ACL role '%s'. Nothing to update.", role.Name)
+			continue
+		}
+		upserts = append(upserts, aclObjectChange{
+			Action:      actionUpdate,
+			Kind:        aclKindRole,
+			ID:          existing.ID,
+			Name:        role.Name,
+			Role:        &role,
+			Old:         old.describe(),
+			ModifyIndex: existing.ModifyIndex,
+		})
+	}
+
+	deletes := []aclObjectChange{}
+	for _, role := range roles {
+		if declared[role.Name] {
+			continue
+		}
+		log.Warningf("Found unexpected ACL role '%s' with ID: %s", role.Name, role.ID)
+		deletes = append(deletes, aclObjectChange{
+			Action:      actionDelete,
+			Kind:        aclKindRole,
+			ID:          role.ID,
+			Name:        role.Name,
+			ModifyIndex: role.ModifyIndex,
+		})
+	}
+	sort.Slice(deletes, func(i, j int) bool { return deletes[i].Name < deletes[j].Name })
+
+	return upserts, deletes, nil
+}
+
+// aclTokenListEntry keeps the Legacy flag of a listed token, which the API
+// client doesn't decode
+type aclTokenListEntry struct {
+	consulapi.ACLTokenListEntry
+	Legacy bool
+}
+
+// listAclTokens lists the tokens of the ACL system. The legacy ACLs, which
+// Consul 1.4 to 1.10 list as tokens too, are left out: they are managed by the
+// policies section.
+func (consul *consulClient) listAclTokens(q *consulapi.QueryOptions) ([]*consulapi.ACLTokenListEntry, error) {
+	entries := []*aclTokenListEntry{}
+	if _, err := consul.Client.Raw().Query("/v1/acl/tokens", &entries, q); err != nil {
+		return nil, err
+	}
+	tokens := []*consulapi.ACLTokenListEntry{}
+	for _, entry := range entries {
+		if !entry.Legacy {
+			tokens = append(tokens, &entry.ACLTokenListEntry)
+		}
+	}
+	return tokens, nil
+}
+
+func (consul *consulClient) planAclTokens(newTokens []aclToken, changes *plan) ([]aclObjectChange, []aclObjectChange, error) {
+	q := consulapi.QueryOptions{}
+	tokens, err := consul.listAclTokens(&q)
+	if err != nil {
+		log.Errorf("Failed to list ACL tokens. %v", err)
+		return nil, nil, err
+	}
+
+	// The token used by config2consul itself is never touched
+	selfAccessorID := ""
+	if self, _, err := consul.Client.ACL().TokenReadSelf(&q); err == nil {
+		selfAccessorID = self.AccessorID
+	}
+
+	byAccessor := make(map[string]*consulapi.ACLTokenListEntry)
+	byDescription := make(map[string][]*consulapi.ACLTokenListEntry)
+	protected := []aclObjectChange{}
+	for _, token := range tokens {
+		if token.AccessorID == anonymousTokenAccessorID || token.AccessorID == selfAccessorID || token.AuthMethod != "" {
+			protected = append(protected, aclObjectChange{Action: actionIgnore, Kind: aclKindToken, ID: token.AccessorID, Name: token.Description})
+			continue
+		}
+		changes.ManagedAcls++
+		byAccessor[token.AccessorID] = token
+		byDescription[token.Description] = append(byDescription[token.Description], token)
+	}
+
+	declared := make(map[string]bool)
+	upserts := []aclObjectChange{}
+	for i := range newTokens {
+		token := newTokens[i]
+		id := token.AccessorID
+		if id == "" {
+			id = token.Description
+		}
+		if declared[id] {
+			return nil, nil, fmt.Errorf("Found duplicate ACL token '%s' in the injest.", id)
+		}
+		declared[id] = true
+
+		existing, ok := byAccessor[token.AccessorID]
+		if !ok && token.AccessorID == "" {
+			existing, ok, err = findTokenByDescription(byDescription, token.Description)
+			if err != nil {
+				log.Error(err)
+				return nil, nil, err
+			}
+		}
+		if !ok {
+			upserts = append(upserts, aclObjectChange{Action: actionCreate, Kind: aclKindToken, Name: token.Description, Token: &token})
+			continue
+		}
+		declared[existing.AccessorID] = true
+
+		if token.SecretID != "" {
+			full, _, err := consul.Client.ACL().TokenRead(existing.AccessorID, &q)
+			if err != nil {
+				log.Errorf("Failed to read ACL token '%s'. %v", token.Description, err)
+				return nil, nil, err
+			}
+			if full.SecretID != token.SecretID {
+				return nil, nil, fmt.Errorf("The secret of the ACL token '%s' can't be changed. Delete the token to rotate it.", token.Description)
+			}
+		}
+
+		old := tokenFromConsul(existing)
+		if reflect.DeepEqual(normalizeToken(token, old), normalizeToken(old, old)) {
+			log.Infof("Skipping ACL token '%s'. Nothing to update.", token.Description)
+			continue
+		}
+		update := updatableToken(token, old)
+		upserts = append(upserts, aclObjectChange{
+			Action:      actionUpdate,
+			Kind:        aclKindToken,
+			ID:          existing.AccessorID,
+			Name:        token.Description,
+			Token:       &update,
+			Old:         old.describe(),
+			ModifyIndex: existing.ModifyIndex,
+		})
+	}
+
+	deletes := []aclObjectChange{}
+	for _, token := range byAccessor {
+		if declared[token.AccessorID] {
+			continue
+		}
+		if protection := findProtection(protectedAcls(), token.AccessorID, token.Description); protection != nil {
+			log.Infof("Preserving ACL token '%s'. %s", token.Description, protectionReason(protection))
+			protected = append(protected, aclObjectChange{Action: actionIgnore, Kind: aclKindToken, ID: token.AccessorID, Name: token.Description, Reason: protectionReason(protection)})
+			continue
+		}
+		log.Warningf("Found unexpected ACL token '%s' with accessor ID: %s", token.Description, token.AccessorID)
+		deletes = append(deletes, aclObjectChange{
+			Action:      actionDelete,
+			Kind:        aclKindToken,
+			ID:          token.AccessorID,
+			Name:        token.Description,
+			ModifyIndex: token.ModifyIndex,
+		})
+	}
+	deletes = append(deletes, protected...)
+	sort.Slice(deletes, func(i, j int) bool { return deletes[i].Name < deletes[j].Name })
+
+	return upserts, deletes, nil
+}
+
+// findTokenByDescription looks up the existing token a token declared without
+// an accessor_id refers to. Several tokens with the description are ambiguous.
+func findTokenByDescription(byDescription map[string][]*consulapi.ACLTokenListEntry, description string) (*consulapi.ACLTokenListEntry, bool, error) {
+	found := byDescription[description]
+	switch len(found) {
+	case 0:
+		return nil, false, nil
+	case 1:
+		return found[0], true, nil
+	}
+	ids := []string{}
+	for _, token := range found {
+		ids = append(ids, token.AccessorID)
+	}
+	sort.Strings(ids)
+	return nil, false, fmt.Errorf("Found existing ACL tokens with description '%s'. accessor ids: (%s). Declare the token with its accessor_id.", description, strings.Join(ids, ", "))
+}
+
+func (consul *consulClient) applyAclObjectChange(change *aclObjectChange) (bool, error) {
+	w := consulapi.WriteOptions{}
+	var err error
+
+	switch {
+	case change.Action == actionIgnore:
+		return true, nil
+	case change.Action == actionDelete:
+		log.Warningf("Deleting unexpected ACL %s '%s' with ID: %s", change.Kind, change.Name, change.ID)
+		switch change.Kind {
+		case aclKindPolicy:
+			_, err = consul.Client.ACL().PolicyDelete(change.ID, &w)
+		case aclKindRole:
+			_, err = consul.Client.ACL().RoleDelete(change.ID, &w)
+		case aclKindToken:
+			_, err = consul.Client.ACL().TokenDelete(change.ID, &w)
+		}
+	case change.Kind == aclKindPolicy:
+		policy := change.Policy.toConsul()
+		policy.ID = change.ID
+		if change.Action == actionCreate {
+			_, _, err = consul.Client.ACL().PolicyCreate(policy, &w)
+		} else {
+			_, _, err = consul.Client.ACL().PolicyUpdate(policy, &w)
+		}
+	case change.Kind == aclKindRole:
+		role := change.Role.toConsul()
+		role.ID = change.ID
+		if change.Action == actionCreate {
+			_, _, err = consul.Client.ACL().RoleCreate(role, &w)
+		} else {
+			_, _, err = consul.Client.ACL().RoleUpdate(role, &w)
+		}
+	case change.Kind == aclKindToken:
+		var token *consulapi.ACLToken
+		token, err = change.Token.toConsul()
+		if err != nil {
+			break
+		}
+		if change.Action == actionCreate {
+			_, _, err = consul.Client.ACL().TokenCreate(token, &w)
+		} else {
+			token.AccessorID = change.ID
+			_, _, err = consul.Client.ACL().TokenUpdate(token, &w)
+		}
+	}
+
+	if err != nil {
+		log.Errorf("Failed to %s ACL %s '%s'. %v", change.Action, change.Kind, change.Name, err)
+		return false, err
+	}
+	if change.Action != actionDelete {
+		log.Infof("ACL %s '%s' has been %sd", change.Kind, change.Name, change.Action)
+	}
+	return true, nil
+}
+
+// aclObjectVersion identifies an existing policy, role or token
+type aclObjectVersion struct {
+	ID          string
+	Name        string
+	ModifyIndex uint64
+}
+
+// verifyAclObjects returns the reasons why the changes are stale
+func (consul *consulClient) verifyAclObjects(changes []aclObjectChange) ([]string, error) {
+	q := consulapi.QueryOptions{}
+	current := make(map[string][]aclObjectVersion)
+	for _, change := range changes {
+		if _, listed := current[change.Kind]; listed || change.Action == actionIgnore {
+			continue
+		}
+		versions := []aclObjectVersion{}
+		switch change.Kind {
+		case aclKindPolicy:
+			policies, _, err := consul.Client.ACL().PolicyList(&q)
+			if err != nil {
+				return nil, err
+			}
+			for _, policy := range policies {
+				versions = append(versions, aclObjectVersion{policy.ID, policy.Name, policy.ModifyIndex})
+			}
+		case aclKindRole:
+			roles, _, err := consul.Client.ACL().RoleList(&q)
+			if err != nil {
+				return nil, err
+			}
+			for _, role := range roles {
+				versions = append(versions, aclObjectVersion{role.ID, role.Name, role.ModifyIndex})
+			}
+		case aclKindToken:
+			tokens, err := consul.listAclTokens(&q)
+			if err != nil {
+				return nil, err
+			}
+			for _, token := range tokens {
+				versions = append(versions, aclObjectVersion{token.AccessorID, token.Description, token.ModifyIndex})
+			}
+		}
+		current[change.Kind] = versions
+	}
+
+	stale := []string{}
+	for _, change := range changes {
+		switch change.Action {
+		case actionCreate:
+			for _, version := range current[change.Kind] {
+				if version.Name == change.Name || (change.Token != nil && version.ID == change.Token.AccessorID) {
+					stale = append(stale, fmt.Sprintf("ACL %s '%s' was created with ID: %s", change.Kind, change.Name, version.ID))
+				}
+			}
+		case actionUpdate, actionDelete:
+			found := false
+			for _, version := range current[change.Kind] {
+				if version.ID != change.ID {
+					continue
+				}
+				found = true
+				if version.ModifyIndex != change.ModifyIndex {
+					stale = append(stale, fmt.Sprintf("ACL %s '%s' with ID: %s was modified (index %d => %d)", change.Kind, change.Name, change.ID, change.ModifyIndex, version.ModifyIndex))
+				}
+			}
+			if !found {
+				stale = append(stale, fmt.Sprintf("ACL %s '%s' with ID: %s was deleted", change.Kind, change.Name, change.ID))
+			}
+		}
+	}
+	return stale, nil
+}
+
+func policyFromConsul(policy *consulapi.ACLPolicy) aclPolicy {
+	return aclPolicy{
+		Name:        policy.Name,
+		Description: policy.Description,
+		Rules:       policy.Rules,
+		Datacenters: policy.Datacenters,
+	}
+}
+
+func roleFromConsul(role *consulapi.ACLRole) aclRole {
+	return aclRole{
+		Name:              role.Name,
+		Description:       role.Description,
+		Policies:          linkNames(role.Policies),
+		ServiceIdentities: serviceIdentitiesFromConsul(role.ServiceIdentities),
+		NodeIdentities:    nodeIdentitiesFromConsul(role.NodeIdentities),
+	}
+}
+
+func tokenFromConsul(token *consulapi.ACLTokenListEntry) aclToken {
+	return aclToken{
+		AccessorID:        token.AccessorID,
+		Description:       token.Description,
+		Policies:          linkNames(token.Policies),
+		Roles:             linkNames(token.Roles),
+		ServiceIdentities: serviceIdentitiesFromConsul(token.ServiceIdentities),
+		NodeIdentities:    nodeIdentitiesFromConsul(token.NodeIdentities),
+		Local:             token.Local,
+	}
+}
+
+func (policy *aclPolicy) toConsul() *consulapi.ACLPolicy {
+	return &consulapi.ACLPolicy{
+		Name:        policy.Name,
+		Description: policy.Description,
+		Rules:       policy.Rules,
+		Datacenters: policy.Datacenters,
+	}
+}
+
+func (role *aclRole) toConsul() *consulapi.ACLRole {
+	return &consulapi.ACLRole{
+		Name:              role.Name,
+		Description:       role.Description,
+		Policies:          nameLinks(role.Policies),
+		ServiceIdentities: serviceIdentitiesToConsul(role.ServiceIdentities),
+		NodeIdentities:    nodeIdentitiesToConsul(role.NodeIdentities),
+	}
+}
+
+func (token *aclToken) toConsul() (*consulapi.ACLToken, error) {
+	result := consulapi.ACLToken{
+		AccessorID:        token.AccessorID,
+		SecretID:          token.SecretID,
+		Description:       token.Description,
+		Policies:          nameLinks(token.Policies),
+		Roles:             nameLinks(token.Roles),
+		ServiceIdentities: serviceIdentitiesToConsul(token.ServiceIdentities),
+		NodeIdentities:    nodeIdentitiesToConsul(token.NodeIdentities),
+		Local:             token.Local,
+	}
+	if token.ExpirationTTL != "" {
+		ttl, err := time.ParseDuration(token.ExpirationTTL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid expiration_ttl of ACL token '%s'. %v", token.Description, err)
+		}
+		result.ExpirationTTL = ttl
+	}
+	if token.ExpirationTime != "" {
+		expiration, err := time.Parse(time.RFC3339, token.ExpirationTime)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid expiration_time of ACL token '%s'. %v", token.Description, err)
+		}
+		result.ExpirationTime = &expiration
+	}
+	return &result, nil
+}
+
+func normalizePolicy(policy aclPolicy) aclPolicy {
+	policy.Datacenters = sortedStrings(policy.Datacenters)
+	if canonical, err := canonicalRules(policy.Rules); err == nil {
+		policy.Rules = canonical
+	}
+	return policy
+}
+
+func normalizeRole(role aclRole) aclRole {
+	role.Policies = sortedStrings(role.Policies)
+	role.ServiceIdentities = normalizeServiceIdentities(role.ServiceIdentities)
+	role.NodeIdentities = normalizeNodeIdentities(role.NodeIdentities)
+	return role
+}
+
+// normalizeToken drops the fields which are not compared: the ones only
+// applied at creation and the ones taken from the existing token if missing.
+func normalizeToken(token aclToken, existing aclToken) aclToken {
+	token.AccessorID = existing.AccessorID
+	token.SecretID = ""
+	token.Local = existing.Local
+	token.ExpirationTTL = ""
+	token.ExpirationTime = ""
+	token.Policies = sortedStrings(token.Policies)
+	token.Roles = sortedStrings(token.Roles)
+	token.ServiceIdentities = normalizeServiceIdentities(token.ServiceIdentities)
+	token.NodeIdentities = normalizeNodeIdentities(token.NodeIdentities)
+	return token
+}
+
+// updatableToken drops the fields Consul refuses to change on an update: the
+// locality is kept from the existing token and the expiration is left out.
+func updatableToken(token aclToken, existing aclToken) aclToken {
+	token.Local = existing.Local
+	token.ExpirationTTL = ""
+	token.ExpirationTime = ""
+	return token
+}
+
+func (policy *aclPolicy) describe() []string {
+	lines := []string{}
+	if policy.Description != "" {
+		lines = append(lines, "description: "+policy.Description)
+	}
+	if len(policy.Datacenters) > 0 {
+		lines = append(lines, "datacenters: "+strings.Join(policy.Datacenters, ", "))
+	}
+	for _, line := range strings.Split(strings.TrimRight(policy.Rules, "\n"), "\n") {
+		if line != "" {
+			lines = append(lines, "rules: "+line)
+		}
+	}
+	return lines
+}
+
+func (role *aclRole) describe() []string {
+	lines := []string{}
+	if role.Description != "" {
+		lines = append(lines, "description: "+role.Description)
+	}
+	lines = append(lines, describeLinks(role.Policies, role.ServiceIdentities, role.NodeIdentities)...)
+	return lines
+}
+
+func (token *aclToken) describe() []string {
+	lines := []string{}
+	for _, role := range sortedStrings(token.Roles) {
+		lines = append(lines, "role: "+role)
+	}
+	lines = append(lines, describeLinks(token.Policies, token.ServiceIdentities, token.NodeIdentities)...)
+	if token.Local {
+		lines = append(lines, "local: true")
+	}
+	return lines
+}
+
+func (change *aclObjectChange) describe() []string {
+	switch {
+	case change.Policy != nil:
+		return change.Policy.describe()
+	case change.Role != nil:
+		return change.Role.describe()
+	case change.Token != nil:
+		return change.Token.describe()
+	}
+	return []string{}
+}
+
+func describeLinks(policies []string, services []serviceIdentity, nodes []nodeIdentity) []string {
+	lines := []string{}
+	for _, policy := range sortedStrings(policies) {
+		lines = append(lines, "policy: "+policy)
+	}
+	for _, service := range normalizeServiceIdentities(services) {
+		line := "service identity: " + service.ServiceName
+		if len(service.Datacenters) > 0 {
+			line += " (" + strings.Join(service.Datacenters, ", ") + ")"
+		}
+		lines = append(lines, line)
+	}
+	for _, node := range normalizeNodeIdentities(nodes) {
+		lines = append(lines, fmt.Sprintf("node identity: %s (%s)", node.NodeName, node.Datacenter))
+	}
+	return lines
+}
+
+func linkNames(links []*consulapi.ACLLink) []string {
+	names := []string{}
+	for _, link := range links {
+		names = append(names, link.Name)
+	}
+	return names
+}
+
+func nameLinks(names []string) []*consulapi.ACLLink {
+	links := []*consulapi.ACLLink{}
+	for _, name := range names {
+		links = append(links, &consulapi.ACLLink{Name: name})
+	}
+	return links
+}
+
+func serviceIdentitiesFromConsul(identities []*consulapi.ACLServiceIdentity) []serviceIdentity {
+	result := []serviceIdentity{}
+	for _, identity := range identities {
+		result = append(result, serviceIdentity{ServiceName: identity.ServiceName, Datacenters: identity.Datacenters})
+	}
+	return result
+}
+
+func serviceIdentitiesToConsul(identities []serviceIdentity) []*consulapi.ACLServiceIdentity {
+	result := []*consulapi.ACLServiceIdentity{}
+	for _, identity := range identities {
+		result = append(result, &consulapi.ACLServiceIdentity{ServiceName: identity.ServiceName, Datacenters: identity.Datacenters})
+	}
+	return result
+}
+
+func nodeIdentitiesFromConsul(identities []*consulapi.ACLNodeIdentity) []nodeIdentity {
+	result := []nodeIdentity{}
+	for _, identity := range identities {
+		result = append(result, nodeIdentity{NodeName: identity.NodeName, Datacenter: identity.Datacenter})
+	}
+	return result
+}
+
+func nodeIdentitiesToConsul(identities []nodeIdentity) []*consulapi.ACLNodeIdentity {
+	result := []*consulapi.ACLNodeIdentity{}
+	for _, identity := range identities {
+		result = append(result, &consulapi.ACLNodeIdentity{NodeName: identity.NodeName, Datacenter: identity.Datacenter})
+	}
+	return result
+}
+
+func normalizeServiceIdentities(identities []serviceIdentity) []serviceIdentity {
+	result := []serviceIdentity{}
+	for _, identity := range identities {
+		result = append(result, serviceIdentity{ServiceName: identity.ServiceName, Datacenters: sortedStrings(identity.Datacenters)})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ServiceName < result[j].ServiceName })
+	return result
+}
+
+func normalizeNodeIdentities(identities []nodeIdentity) []nodeIdentity {
+	result := append([]nodeIdentity{}, identities...)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].NodeName+"/"+result[i].Datacenter < result[j].NodeName+"/"+result[j].Datacenter
+	})
+	return result
+}
+
+func sortedStrings(values []string) []string {
+	result := append([]string{}, values...)
+	sort.Strings(result)
+	return result
+}
@@ -17,41 +17,111 @@
 package injest
 
 import (
+	"config2consul/config"
 	"config2consul/log"
 	"errors"
 	"fmt"
 	consulapi "github.com/hashicorp/consul/api"
-	"strings"
+	"sort"
 	"strconv"
+	"strings"
 )
 
-func (consul *consulClient) importKeyValue(keyValue *map[string]interface{}) error {
-	q := consulapi.QueryOptions{}
-	// TODO: preserve more information, like "Index"
-	currentKvPairsOrig, _, _ := consul.Client.KV().List("", &q)
-	currentKvPairs := make(map[string]string)
-	for _, kv := range currentKvPairsOrig {
-		log.Debugf("Found %s: %d", kv.Key, kv.CreateIndex)
-		currentKvPairs[kv.Key] = string(kv.Value)
+// kvScope is the list of key prefixes managed by config2consul. Keys outside of
+// the scope are never listed, compared or deleted.
+type kvScope []string
+
+// managedScope combines the managed prefixes of the config file and the rules.
+// The whole keyspace is managed if no prefixes were declared.
+func (consConf *consulConfig) managedScope() kvScope {
+	unique := make(map[string]bool)
+	for _, prefix := range append(config.Conf.ManagedPrefixes, consConf.ManagedPrefixes...) {
+		unique[prefix] = true
+	}
+	if len(unique) == 0 || unique[""] {
+		return kvScope{""}
+	}
+
+	scope := kvScope{}
+	for prefix := range unique {
+		scope = append(scope, prefix)
+	}
+	sort.Strings(scope)
+	return scope
+}
+
+func (scope kvScope) contains(key string) bool {
+	for _, prefix := range scope {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (consul *consulClient) getCurrentKVs(scope kvScope) (map[string]*consulapi.KVPair, error) {
+	// The lock is held by config2consul itself and is never a runaway key
+	lock := lockKey()
+	currentKvPairs := make(map[string]*consulapi.KVPair)
+	for _, prefix := range scope {
+		q := consulapi.QueryOptions{}
+		pairs, _, err := consul.Client.KV().List(prefix, &q)
+		if err != nil {
+			log.Errorf("Failed to list keys with prefix '%s'. %v", prefix, err)
+			return nil, err
+		}
+		for _, kv := range pairs {
+			if kv.Key == lock {
+				continue
+			}
+			log.Debugf("Found %s: %d", kv.Key, kv.CreateIndex)
+			currentKvPairs[kv.Key] = kv
+		}
+	}
+	return currentKvPairs, nil
+}
+
+func (consul *consulClient) planKeyValue(keyValue *map[string]interface{}, scope kvScope, changes *plan) error {
+	if len(scope) > 1 || scope[0] != "" {
+		log.Infof("Managing keys with prefixes: %s", strings.Join(scope, ", "))
+	}
+	currentKvPairs, err := consul.getCurrentKVs(scope)
+	if err != nil {
+		return err
 	}
+	changes.ManagedKeys = len(currentKvPairs)
 
-	err := consul.importTree(keyValue, currentKvPairs)
+	keyChanges := []kvChange{}
+	err = planTree(keyValue, scope, currentKvPairs, &keyChanges)
 	if err != nil {
 		return err
 	}
+	sort.Sort(byKey(keyChanges))
 
 	if len(currentKvPairs) > 0 {
-		log.Infof("Deleting %d runaway key pairs", len(currentKvPairs))
+		log.Infof("Found %d runaway key pairs", len(currentKvPairs))
+		runaway := make([]string, 0, len(currentKvPairs))
 		for key := range currentKvPairs {
-			log.Warningf("Deleting runaway Key '%s'", key)
-			consul.deleteKV(key)
+			runaway = append(runaway, key)
+		}
+		sort.Strings(runaway)
+		for _, key := range runaway {
+			log.Warningf("Found runaway Key '%s'", key)
+			keyChanges = append(keyChanges, kvChange{
+				Action:      actionDelete,
+				Key:         key,
+				OldValue:    string(currentKvPairs[key].Value),
+				OldFlags:    currentKvPairs[key].Flags,
+				ModifyIndex: currentKvPairs[key].ModifyIndex,
+			})
 		}
 	}
 
+	changes.KeyValues = keyChanges
 	return nil
 }
 
-func (consul *consulClient) importTree(keyValue *map[string]interface{}, currentKvPairs map[string]string) error {
+func planTree(keyValue *map[string]interface{}, scope kvScope, currentKvPairs map[string]*consulapi.KVPair, changes *[]kvChange) error {
 
 	for key, i_value := range *keyValue {
 		if len(key) == 0 {
@@ -61,13 +131,24 @@ func (consul *consulClient) importTree(keyValue *map[string]interface{}, current
 		if key[len(key)-1] == '/' {
 			switch value := i_value.(type) {
 			case string:
-				if value == "${ignore}" {
+				if value == "" {
+					// A key ending with a '/' is declared with an empty value
+					if change, ok := planKV(key, value, 0, currentKvPairs[key]); ok {
+						*changes = append(*changes, change)
+					}
+					delete(currentKvPairs, key)
+				} else if value == "${ignore}" {
 					log.Info("Ignoring tree: " + key)
+					*changes = append(*changes, kvChange{Action: actionIgnore, Key: key})
 					for k := range currentKvPairs {
 						if strings.HasPrefix(k, key) {
 							delete(currentKvPairs, k)
 						}
 					}
+				} else if value == deleteValue {
+					err_text := fmt.Sprintf("Can't delete the tree '%s'. '%s' is only valid in an overlay layer", key, deleteValue)
+					log.Error(err_text)
+					return errors.New(err_text)
 				} else {
 					err_text := fmt.Sprintf("Unexpected string value for the key tree '%s' of type: %s", key, value)
 					log.Error(err_text)
@@ -78,29 +159,57 @@ func (consul *consulClient) importTree(keyValue *map[string]interface{}, current
 				map_value := convert_map(&value, key)
 
 				log.Debugf("Importing tree %s", key)
-				consul.importTree(map_value, currentKvPairs)
+				err := planTree(map_value, scope, currentKvPairs, changes)
+				if err != nil {
+					return err
+				}
+			case map[string]interface{}:
+				log.Debugf("Importing tree %s", key)
+				err := planTree(prefix_map(value, key), scope, currentKvPairs, changes)
+				if err != nil {
+					return err
+				}
 			default:
 				err_text := fmt.Sprintf("Unexpected value for the key tree '%s' of type: %T", key, i_value)
 				log.Error(err_text)
 				return errors.New(err_text)
 			}
 		} else {
-			str_value, ok := get_string_value(i_value)
+			value, flags := splitFlags(i_value)
+			str_value, ok := get_string_value(value)
 			if !ok {
 				err_text := fmt.Sprintf("Unexpected value for the key '%s': %T", key, i_value)
 				log.Error(err_text)
 				return errors.New(err_text)
 			}
 
-			var done bool
+			// An ignored key is never written, so it may be outside of the scope
 			if str_value == "${ignore}" {
-				done = true
-			} else {
-				done, _ = consul.applyKV(key, str_value, &currentKvPairs)
-			}
-			if done {
+				*changes = append(*changes, kvChange{Action: actionIgnore, Key: key})
 				delete(currentKvPairs, key)
+				continue
 			}
+			if !scope.contains(key) {
+				err_text := fmt.Sprintf("Key '%s' is outside of the managed prefixes: %s", key, strings.Join(scope, ", "))
+				log.Error(err_text)
+				return errors.New(err_text)
+			}
+
+			if str_value == deleteValue {
+				err_text := fmt.Sprintf("Can't delete the key '%s'. '%s' is only valid in an overlay layer", key, deleteValue)
+				log.Error(err_text)
+				return errors.New(err_text)
+			}
+
+			current := currentKvPairs[key]
+			if declared, isJSON := value.(jsonValue); isJSON && current != nil && sameJSON(string(current.Value), declared) {
+				// The same structure in another formatting is not a change
+				str_value = string(current.Value)
+			}
+			if change, ok := planKV(key, str_value, flags, current); ok {
+				*changes = append(*changes, change)
+			}
+			delete(currentKvPairs, key)
 		}
 	}
 
@@ -114,6 +223,8 @@ func get_string_value(value interface{}) (string, bool) {
 		str_value = value
 	case *string:
 		str_value = *value
+	case jsonValue:
+		str_value = string(value)
 	case bool:
 		str_value = strconv.FormatBool(value)
 	case int:
@@ -137,7 +248,7 @@ func convert_map(input *map[interface{}]interface{}, path_prefix string) *map[st
 		case string:
 			key_path := path_prefix + key
 			switch value := value.(type) {
-			case string:
+			case string, jsonValue, flaggedValue:
 				output[key_path] = value
 			default:
 				output[key_path+"/"] = value
@@ -148,38 +259,106 @@ func convert_map(input *map[interface{}]interface{}, path_prefix string) *map[st
 	return &output
 }
 
-func (consul *consulClient) applyKV(key string, value string, currentKVList *map[string]string) (bool, error) {
-	w := consulapi.WriteOptions{}
-
-	if currentValue, ok := (*currentKVList)[key]; ok {
-		if value == "${ignore}" || value == currentValue {
-			return true, nil
+// prefix_map prefixes the keys of a tree with its path
+func prefix_map(input map[string]interface{}, path_prefix string) *map[string]interface{} {
+	output := make(map[string]interface{})
+	for key, value := range input {
+		switch value.(type) {
+		case string, jsonValue, flaggedValue:
+			output[path_prefix+key] = value
+		default:
+			output[path_prefix+key+"/"] = value
 		}
-
-		log.Warningf("Value of key %s has been changed. Overwriting ...", key)
 	}
+	return &output
+}
 
-	kv := consulapi.KVPair{
-		Key:   key,
-		Value: []byte(value),
+// planKV compares a declared value and flags with the existing pair (if any).
+// Returns false if nothing has to be done.
+func planKV(key string, value string, flags uint64, current *consulapi.KVPair) (kvChange, bool) {
+	if current == nil {
+		return kvChange{Action: actionCreate, Key: key, Value: value, Flags: flags}, true
 	}
-	_, err := consul.Client.KV().Put(&kv, &w)
-	if err != nil {
-		err_text := fmt.Sprintf("#2 Failed to update key '%s' with value '%s'. %#v", key, value, err)
-		log.Error(err_text)
-		return false, errors.New(err_text)
+
+	currentValue := string(current.Value)
+	if value == currentValue && flags == current.Flags {
+		return kvChange{}, false
 	}
 
-	return true, nil
+	if value == currentValue {
+		log.Warningf("Flags of key %s have been changed", key)
+	} else {
+		log.Warningf("Value of key %s has been changed", key)
+	}
+	return kvChange{
+		Action:      actionUpdate,
+		Key:         key,
+		Value:       value,
+		OldValue:    currentValue,
+		Flags:       flags,
+		OldFlags:    current.Flags,
+		ModifyIndex: current.ModifyIndex,
+	}, true
 }
 
-func (consul *consulClient) deleteKV(key string) (bool, error) {
-	w := consulapi.WriteOptions{}
-	log.Info("Deleting key: " + key)
-	_, err := consul.Client.KV().Delete(key, &w)
-	if err != nil {
-		log.Errorf("Failed to delete key: %s. %v", key, err)
-		return false, err
+// maxTxnOps is the maximum number of operations Consul accepts in a single
+// transaction
+const maxTxnOps = 64
+
+// applyKVChanges writes the changes using check-and-set transactions. Each
+// transaction is all-or-nothing, so a failure never leaves a chunk half applied.
+func (consul *consulClient) applyKVChanges(changes []kvChange) error {
+	ops := consulapi.KVTxnOps{}
+	for _, change := range changes {
+		switch change.Action {
+		case actionCreate, actionUpdate:
+			// Index 0 makes sure the key still doesn't exist
+			ops = append(ops, &consulapi.KVTxnOp{
+				Verb:  consulapi.KVCAS,
+				Key:   change.Key,
+				Value: []byte(change.Value),
+				Flags: change.Flags,
+				Index: change.ModifyIndex,
+			})
+		case actionDelete:
+			log.Warningf("Deleting runaway Key '%s'", change.Key)
+			ops = append(ops, &consulapi.KVTxnOp{
+				Verb:  consulapi.KVDeleteCAS,
+				Key:   change.Key,
+				Index: change.ModifyIndex,
+			})
+		}
 	}
-	return true, nil
+
+	total := (len(ops) + maxTxnOps - 1) / maxTxnOps
+	for start := 0; start < len(ops); start += maxTxnOps {
+		end := start + maxTxnOps
+		if end > len(ops) {
+			end = len(ops)
+		}
+		chunk := ops[start:end]
+		number := start/maxTxnOps + 1
+
+		q := consulapi.QueryOptions{}
+		ok, response, _, err := consul.Client.KV().Txn(chunk, &q)
+		if err != nil {
+			log.Errorf("Transaction %d of %d (keys '%s' .. '%s') failed. %v", number, total, chunk[0].Key, chunk[len(chunk)-1].Key, err)
+			return fmt.Errorf("KV transaction %d of %d failed. %d of %d key changes were applied", number, total, start, len(ops))
+		}
+		if !ok {
+			for _, txnErr := range response.Errors {
+				log.Errorf("Transaction %d of %d rolled back. Key '%s': %s", number, total, chunk[txnErr.OpIndex].Key, txnErr.What)
+			}
+			return fmt.Errorf("KV transaction %d of %d was rolled back. %d of %d key changes were applied", number, total, start, len(ops))
+		}
+		log.Infof("Transaction %d of %d applied %d key change(s)", number, total, len(chunk))
+	}
+
+	return nil
 }
+
+type byKey []kvChange
+
+func (changes byKey) Len() int           { return len(changes) }
+func (changes byKey) Swap(i, j int)      { changes[i], changes[j] = changes[j], changes[i] }
+func (changes byKey) Less(i, j int) bool { return changes[i].Key < changes[j].Key }
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"bytes"
+	"config2consul/config"
+	"config2consul/log"
+	consulapi "github.com/hashicorp/consul/api"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAclSystemComparison(t *testing.T) {
+	Convey("Comparing ACL system objects", t, func() {
+		Convey("Roles are equal regardless of the order of the links", func() {
+			declared := aclRole{
+				Name:     "app",
+				Policies: []string{"b", "a"},
+				ServiceIdentities: []serviceIdentity{
+					{ServiceName: "web"},
+					{ServiceName: "db", Datacenters: []string{"dc2", "dc1"}},
+				},
+			}
+			existing := roleFromConsul(&consulapi.ACLRole{
+				Name:     "app",
+				Policies: []*consulapi.ACLLink{{ID: "1", Name: "a"}, {ID: "2", Name: "b"}},
+				ServiceIdentities: []*consulapi.ACLServiceIdentity{
+					{ServiceName: "db", Datacenters: []string{"dc1", "dc2"}},
+					{ServiceName: "web"},
+				},
+			})
+			So(normalizeRole(declared), ShouldResemble, normalizeRole(existing))
+
+			declared.Policies = []string{"a"}
+			So(normalizeRole(declared), ShouldNotResemble, normalizeRole(existing))
+		})
+
+		Convey("Token fields applied only on creation are not compared", func() {
+			existing := tokenFromConsul(&consulapi.ACLTokenListEntry{
+				AccessorID:  "accessor",
+				Description: "app token",
+				Policies:    []*consulapi.ACLLink{{ID: "1", Name: "app"}},
+				Local:       true,
+			})
+			declared := aclToken{
+				Description:   "app token",
+				SecretID:      "secret",
+				Policies:      []string{"app"},
+				ExpirationTTL: "24h",
+			}
+			So(normalizeToken(declared, existing), ShouldResemble, normalizeToken(existing, existing))
+
+			declared.Roles = []string{"admin"}
+			So(normalizeToken(declared, existing), ShouldNotResemble, normalizeToken(existing, existing))
+		})
+
+		Convey("Token updates leave out the fields applied only on creation", func() {
+			existing := aclToken{AccessorID: "accessor", Description: "app token", Local: true}
+			declared := aclToken{
+				Description:    "app token",
+				Roles:          []string{"admin"},
+				ExpirationTTL:  "24h",
+				ExpirationTime: "2030-01-01T00:00:00Z",
+			}
+			update := updatableToken(declared, existing)
+			result, err := update.toConsul()
+			So(err, ShouldBeNil)
+			So(result.Local, ShouldBeTrue)
+			So(result.ExpirationTTL, ShouldEqual, 0)
+			So(result.ExpirationTime, ShouldBeNil)
+			So(result.Roles, ShouldResemble, []*consulapi.ACLLink{{Name: "admin"}})
+		})
+
+		Convey("Token expiration is validated", func() {
+			token := aclToken{Description: "app token", ExpirationTTL: "1h"}
+			result, err := token.toConsul()
+			So(err, ShouldBeNil)
+			So(result.ExpirationTTL, ShouldEqual, time.Hour)
+
+			token.ExpirationTTL = "tomorrow"
+			_, err = token.toConsul()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("An update prints only the changed lines", func() {
+			change := aclObjectChange{
+				Action: actionUpdate,
+				Kind:   aclKindRole,
+				Name:   "app",
+				Role:   &aclRole{Name: "app", Policies: []string{"a", "c"}},
+				Old:    []string{"policy: a", "policy: b"},
+			}
+			var out bytes.Buffer
+			printAclObjectChange(&out, &change)
+			So(out.String(), ShouldContainSubstring, "- policy: b")
+			So(out.String(), ShouldContainSubstring, "+ policy: c")
+			So(out.String(), ShouldNotContainSubstring, "policy: a")
+		})
+	})
+}
+
+func TestAclTokenPlan(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	Convey("Planning ACL tokens", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1/acl/tokens" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(`[
+				{"AccessorID": "legacy", "Description": "Vault app", "Legacy": true},
+				{"AccessorID": "vault", "Description": "Vault db"},
+				{"AccessorID": "unnamed-1", "Description": ""},
+				{"AccessorID": "unnamed-2", "Description": ""},
+				{"AccessorID": "app", "Description": "app token"}
+			]`))
+		}))
+		defer server.Close()
+		client, err := consulapi.NewClient(&consulapi.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+		So(err, ShouldBeNil)
+		consul := consulClient{Client: client}
+
+		defer func() { config.Conf = config.Config{} }()
+		config.Conf.ProtectedAcls = []config.ProtectedAcl{{Prefix: "Vault ", Reason: "Created by Vault"}}
+
+		Convey("Legacy tokens are left out and protected tokens are ignored", func() {
+			upserts, deletes, err := consul.planAclTokens([]aclToken{{AccessorID: "app", Description: "app token"}}, &plan{})
+			So(err, ShouldBeNil)
+			So(upserts, ShouldBeEmpty)
+
+			actions := map[string]string{}
+			for _, change := range deletes {
+				actions[change.ID] = change.Action
+				if change.ID == "vault" {
+					So(change.Reason, ShouldEqual, "protected: Created by Vault")
+				}
+			}
+			So(actions, ShouldResemble, map[string]string{"vault": actionIgnore, "unnamed-1": actionDelete, "unnamed-2": actionDelete})
+		})
+
+		Convey("Only a declared token looking up an ambiguous description fails", func() {
+			_, _, err := consul.planAclTokens([]aclToken{{Description: ""}}, &plan{})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "unnamed-1, unnamed-2")
+		})
+	})
+}
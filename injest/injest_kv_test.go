@@ -2,6 +2,7 @@ package injest
 
 import (
 	"config2consul/log"
+	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
 	"testing"
 )
@@ -147,5 +148,69 @@ func TestInjestKV(t *testing.T) {
 			result := GetValue(t, consul, "a/b/c")
 			So(string(result.Value), ShouldEqual, "d")
 		})
+
+		Convey("KV changes are split into transactions", func() {
+			keyValue := map[string]interface{}{}
+			for i := 0; i < maxTxnOps*2+1; i++ {
+				keyValue[fmt.Sprintf("txn/key%03d", i)] = fmt.Sprintf("value %d", i)
+			}
+			configData := consulConfig{
+				KeyValue: keyValue,
+			}
+			err := importConfig(consul, &configData)
+			So(err, ShouldBeNil)
+
+			So(string(GetValue(t, consul, "txn/key000").Value), ShouldEqual, "value 0")
+			So(string(GetValue(t, consul, fmt.Sprintf("txn/key%03d", maxTxnOps*2)).Value), ShouldEqual, fmt.Sprintf("value %d", maxTxnOps*2))
+		})
+
+		Convey("A KV transaction is rolled back if a key was changed meanwhile", func() {
+			CreateKV(t, consul, "cas/a", []byte("old"))
+			CreateKV(t, consul, "cas/b", []byte("old"))
+			configData := consulConfig{
+				KeyValue: map[string]interface{}{
+					"cas/a": "new",
+					"cas/b": "new",
+				},
+			}
+			changes, err := consul.planConfig(&configData)
+			So(err, ShouldBeNil)
+
+			CreateKV(t, consul, "cas/b", []byte("changed meanwhile"))
+
+			err = consul.applyPlan(changes)
+			So(err, ShouldNotBeNil)
+			So(string(GetValue(t, consul, "cas/a").Value), ShouldEqual, "old")
+			So(string(GetValue(t, consul, "cas/b").Value), ShouldEqual, "changed meanwhile")
+		})
+
+		Convey("Keys outside of the managed prefixes are left alone", func() {
+			CreateKV(t, consul, "team-a/runaway", []byte("foo"))
+			CreateKV(t, consul, "team-b/other", []byte("bar"))
+			configData := consulConfig{
+				ManagedPrefixes: []string{"team-a/"},
+				KeyValue: map[string]interface{}{
+					"team-a/key": "value",
+				},
+			}
+			err := importConfig(consul, &configData)
+			So(err, ShouldBeNil)
+
+			So(string(GetValue(t, consul, "team-a/key").Value), ShouldEqual, "value")
+			So(GetValue(t, consul, "team-a/runaway"), ShouldBeNil)
+			So(string(GetValue(t, consul, "team-b/other").Value), ShouldEqual, "bar")
+		})
+
+		Convey("A key outside of the managed prefixes is rejected", func() {
+			configData := consulConfig{
+				ManagedPrefixes: []string{"team-a/"},
+				KeyValue: map[string]interface{}{
+					"team-b/key": "value",
+				},
+			}
+			err := importConfig(consul, &configData)
+			So(err, ShouldNotBeNil)
+			So(GetValue(t, consul, "team-b/key"), ShouldBeNil)
+		})
 	})
 }
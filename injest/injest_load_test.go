@@ -0,0 +1,811 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"bytes"
+	"config2consul/config"
+	"config2consul/log"
+	"crypto/sha256"
+	"fmt"
+	consulapi "github.com/hashicorp/consul/api"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// writeRules creates the rule files (relative path to content) in a new
+// temporary directory
+func writeRules(files map[string]string) string {
+	dir, err := ioutil.TempDir("", "config2consul")
+	So(err, ShouldBeNil)
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		So(os.MkdirAll(filepath.Dir(path), 0755), ShouldBeNil)
+		So(ioutil.WriteFile(path, []byte(content), 0644), ShouldBeNil)
+	}
+	return dir
+}
+
+func TestLoadRules(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	Convey("Loading a rules directory", t, func() {
+		defer func() { config.Conf = config.Config{} }()
+
+		dir := writeRules(map[string]string{
+			"kv.yml":                   "kv:\n  top: level\n",
+			"team-b/prod/kv.yaml":      "kv:\n  b: prod\n",
+			"team-a/kv.yml":            "kv:\n  a: base\n",
+			"team-a/README.md":         "not a rule",
+			"team-a/archive/old.yml":   "kv:\n  a: old\n",
+			".github/workflows/ci.yml": "on: push\n",
+			"team-a/.hidden.yml":       "kv:\n  hidden: true\n",
+		})
+		defer os.RemoveAll(dir)
+
+		relative := func(files []string) []string {
+			result := []string{}
+			for _, file := range files {
+				rel, _ := filepath.Rel(dir, file)
+				result = append(result, filepath.ToSlash(rel))
+			}
+			return result
+		}
+
+		Convey("Loads the yaml files of all subdirectories in lexical order", func() {
+			files, err := ruleFiles(dir)
+			So(err, ShouldBeNil)
+			So(relative(files), ShouldResemble, []string{"kv.yml", "team-a/archive/old.yml", "team-a/kv.yml", "team-b/prod/kv.yaml"})
+		})
+
+		Convey("Exclude patterns skip files and whole directories", func() {
+			config.Conf.ExcludeFiles = []string{"archive", "team-b/*/kv.yaml"}
+			files, err := ruleFiles(dir)
+			So(err, ShouldBeNil)
+			So(relative(files), ShouldResemble, []string{"kv.yml", "team-a/kv.yml"})
+		})
+
+		Convey("Include patterns replace the default extensions", func() {
+			config.Conf.IncludeFiles = []string{"*.yaml"}
+			files, err := ruleFiles(dir)
+			So(err, ShouldBeNil)
+			So(relative(files), ShouldResemble, []string{"team-b/prod/kv.yaml"})
+		})
+	})
+}
+
+func TestRuleConflicts(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	load := func(files map[string]string) (*consulConfig, error) {
+		dir := writeRules(files)
+		defer os.RemoveAll(dir)
+
+		masterConfig := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+		paths, err := ruleFiles(dir)
+		So(err, ShouldBeNil)
+		for _, path := range paths {
+			if err := loadFile(path, &masterConfig); err != nil {
+				return nil, err
+			}
+		}
+		return &masterConfig, nil
+	}
+
+	Convey("Loading conflicting rule files", t, func() {
+		Convey("Files with different keys and ACLs are merged", func() {
+			rules, err := load(map[string]string{
+				"a.yml": "kv:\n  a: one\npolicies:\n  - name: a\n",
+				"b.yml": "kv:\n  b: two\npolicies:\n  - name: b\n",
+			})
+			So(err, ShouldBeNil)
+			So(rules.KeyValue, ShouldResemble, map[string]interface{}{"a": "one", "b": "two"})
+			So(len(rules.Policies), ShouldEqual, 2)
+		})
+
+		Convey("A key defined by two files names both files and lines", func() {
+			_, err := load(map[string]string{
+				"a.yml": "kv:\n  shared: one\n",
+				"b.yml": "---\nkv:\n  other: x\n  shared: two\n",
+			})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "key 'shared'")
+			So(err.Error(), ShouldContainSubstring, "a.yml:2")
+			So(err.Error(), ShouldContainSubstring, "b.yml:4")
+		})
+
+		Convey("A key nested in a tree of one file and declared by another is a conflict", func() {
+			_, err := load(map[string]string{
+				"a.yml": "kv:\n  app/:\n    db: one\n",
+				"b.yml": "kv:\n  app/db: two\n",
+			})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "key 'app/db'")
+			So(err.Error(), ShouldContainSubstring, "a.yml:3")
+			So(err.Error(), ShouldContainSubstring, "b.yml:2")
+		})
+
+		Convey("Trees of several files with different keys are merged", func() {
+			rules, err := load(map[string]string{
+				"a.yml": "kv:\n  app/:\n    db: x\n",
+				"b.yml": "kv:\n  app/:\n    cache:\n      size: small\n",
+			})
+			So(err, ShouldBeNil)
+			flat, err := flattenKV(rules.KeyValue)
+			So(err, ShouldBeNil)
+			So(flat, ShouldResemble, map[string]interface{}{"app/db": "x", "app/cache/size": "small"})
+		})
+
+		Convey("An ACL defined by two files is a conflict", func() {
+			_, err := load(map[string]string{
+				"a.yml":      "policies:\n  - name: app\n    type: client\n",
+				"team/b.yml": "policies:\n  - name: app\n    type: management\n",
+			})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "ACL 'app'")
+			So(err.Error(), ShouldContainSubstring, "a.yml:2")
+			So(err.Error(), ShouldContainSubstring, "b.yml:2")
+		})
+
+		Convey("An ACL defined twice in a file is a conflict", func() {
+			_, err := load(map[string]string{
+				"a.yml": "acl_policies:\n  - name: app\n  - name: app\n",
+			})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "a.yml:2 and ")
+			So(err.Error(), ShouldContainSubstring, "a.yml:3")
+		})
+
+		Convey("Managed prefixes must end with a '/'", func() {
+			_, err := load(map[string]string{
+				"a.yml": "managed_prefixes:\n  - team-a/\n",
+				"b.yml": "managed_prefixes:\n  - team-b\n",
+			})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEndWith, "b.yml: Managed prefix 'team-b' must end with a '/'")
+		})
+
+		Convey("A file with override replaces earlier definitions", func() {
+			rules, err := load(map[string]string{
+				"a.yml": "kv:\n  shared: one\npolicies:\n  - name: app\n    type: client\n",
+				"b.yml": "override: true\nkv:\n  shared: two\npolicies:\n  - name: app\n    type: management\n",
+			})
+			So(err, ShouldBeNil)
+			So(rules.KeyValue["shared"], ShouldEqual, "two")
+			So(rules.Policies, ShouldResemble, acls{{Name: "app", Type: "management"}})
+		})
+	})
+}
+
+func TestLayers(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	Convey("Merging layers", t, func() {
+		base := writeRules(map[string]string{
+			"kv.yml":   "kv:\n  app/:\n    name: app\n    db:\n      host: localhost\n      port: \"5432\"\n    cache:\n      size: \"10\"\n",
+			"acls.yml": "policies:\n  - name: app\n    type: client\n  - name: ops\n    type: management\n",
+		})
+		defer os.RemoveAll(base)
+
+		layer := func(kv string) string {
+			return writeRules(map[string]string{"kv.yml": kv})
+		}
+
+		Convey("Later layers override single keys of inherited trees", func() {
+			prod := layer("kv:\n  app/:\n    db:\n      host: db.prod\n  extra: value\n")
+			defer os.RemoveAll(prod)
+
+			rules := ImportLayers([]string{base, prod})
+			flat, err := flattenKV(rules.KeyValue)
+			So(err, ShouldBeNil)
+			So(flat, ShouldResemble, map[string]interface{}{
+				"app/name":       "app",
+				"app/db/host":    "db.prod",
+				"app/db/port":    "5432",
+				"app/cache/size": "10",
+				"extra":          "value",
+			})
+		})
+
+		Convey("Inherited keys and trees can be deleted", func() {
+			prod := layer("kv:\n  app/:\n    name: ${delete}\n    cache/: ${delete}\n  missing: ${delete}\n")
+			defer os.RemoveAll(prod)
+
+			rules := ImportLayers([]string{base, prod})
+			flat, err := flattenKV(rules.KeyValue)
+			So(err, ShouldBeNil)
+			So(flat, ShouldResemble, map[string]interface{}{
+				"app/db/host": "localhost",
+				"app/db/port": "5432",
+			})
+		})
+
+		Convey("ACLs with the same name are replaced", func() {
+			prod := writeRules(map[string]string{"acls.yml": "policies:\n  - name: app\n    type: management\n"})
+			defer os.RemoveAll(prod)
+
+			rules := ImportLayers([]string{base, prod})
+			So(rules.Policies, ShouldResemble, acls{{Name: "app", Type: "management"}, {Name: "ops", Type: "management"}})
+		})
+
+		Convey("The merged trees can be planned", func() {
+			prod := layer("kv:\n  app/:\n    db:\n      host: db.prod\n")
+			defer os.RemoveAll(prod)
+
+			rules := ImportLayers([]string{base, prod})
+			changes := []kvChange{}
+			So(planTree(&rules.KeyValue, kvScope{""}, map[string]*consulapi.KVPair{}, &changes), ShouldBeNil)
+			So(len(changes), ShouldEqual, 4)
+		})
+
+		Convey("A deletion outside of a layer is an error", func() {
+			keyValue := map[string]interface{}{"key": deleteValue}
+			changes := []kvChange{}
+			So(planTree(&keyValue, kvScope{""}, map[string]*consulapi.KVPair{}, &changes), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestVariables(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	Convey("Resolving variables", t, func() {
+		defer func() { config.Conf = config.Config{} }()
+		config.Conf.Variables = map[string]string{"dc": "dc1", "region": "eu"}
+		os.Setenv("CONFIG2CONSUL_TEST_TOKEN", "secret")
+		defer os.Unsetenv("CONFIG2CONSUL_TEST_TOKEN")
+
+		load := func(rules string) (*consulConfig, error) {
+			dir := writeRules(map[string]string{"rules.yml": rules})
+			defer os.RemoveAll(dir)
+			masterConfig := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+			err := loadFile(filepath.Join(dir, "rules.yml"), &masterConfig)
+			return &masterConfig, err
+		}
+
+		Convey("Variables, environment variables and defaults are replaced", func() {
+			rules, err := load("kv:\n  ${var.dc}/:\n    region: ${var.region}\n    zone: ${var.zone:-a}\n    empty: \"${var.zone:-}\"\n  token: ${env.CONFIG2CONSUL_TEST_TOKEN}\n  ignored: ${ignore}\n" +
+				"policies:\n  - name: app-${var.dc}\n    rules: key \"${var.dc}/\" { policy = \"read\" }\n")
+			So(err, ShouldBeNil)
+			flat, err := flattenKV(rules.KeyValue)
+			So(err, ShouldBeNil)
+			So(flat, ShouldResemble, map[string]interface{}{
+				"dc1/region": "eu",
+				"dc1/zone":   "a",
+				"dc1/empty":  "",
+				"token":      "secret",
+				"ignored":    "${ignore}",
+			})
+			So(rules.Policies[0].Name, ShouldEqual, "app-dc1")
+			So(rules.Policies[0].Rules, ShouldEqual, `key "dc1/" { policy = "read" }`)
+		})
+
+		Convey("Escaped variables and references are kept literally", func() {
+			rules, err := load("kv:\n  script: echo $${env.HOME} ${var.dc}\n  $${var.dc}/:\n    ref: $${file:x.pem}\n  literal: $$${var.dc}\n" +
+				"policies:\n  - name: app\n    rules: key \"$${var.x}\" { policy = \"read\" }\n")
+			So(err, ShouldBeNil)
+			flat, err := flattenKV(rules.KeyValue)
+			So(err, ShouldBeNil)
+			So(flat, ShouldResemble, map[string]interface{}{
+				"script":        "echo ${env.HOME} dc1",
+				"${var.dc}/ref": "${file:x.pem}",
+				"literal":       "$${var.dc}",
+			})
+			So(rules.Policies[0].Rules, ShouldEqual, `key "${var.x}" { policy = "read" }`)
+		})
+
+		Convey("Keys resolving to the same key are an error", func() {
+			_, err := load("kv:\n  app/:\n    ${var.dc}: one\n    dc1: two\n")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `both resolve to "dc1"`)
+			So(err.Error(), ShouldContainSubstring, `kv["app/"]`)
+		})
+
+		Convey("An unresolved variable names the file and the key", func() {
+			_, err := load("kv:\n  app/:\n    db:\n      host: ${var.db_host}\n")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "var.db_host")
+			So(err.Error(), ShouldContainSubstring, "rules.yml")
+			So(err.Error(), ShouldContainSubstring, `kv["app/"]["db"]["host"]`)
+		})
+	})
+}
+
+func TestTemplates(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	Convey("Rendering rule templates", t, func() {
+		defer func() { config.Conf = config.Config{} }()
+		config.Conf.Variables = map[string]string{"env": "prod", "services": "api,web"}
+
+		load := func(files map[string]string) (*consulConfig, error) {
+			dir := writeRules(files)
+			defer os.RemoveAll(dir)
+			masterConfig := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+			paths, err := ruleFiles(dir)
+			So(err, ShouldBeNil)
+			for _, path := range paths {
+				if err := loadFile(path, &masterConfig); err != nil {
+					return nil, err
+				}
+			}
+			return &masterConfig, nil
+		}
+
+		Convey("Templates generate keys and ACLs", func() {
+			rules, err := load(map[string]string{
+				"services.yml.tmpl": `{{ $services := split .Vars.services "," }}
+kv:
+  services/:
+{{- range $services }}
+    {{ . }}/env: {{ $.Vars.env }}
+{{- end }}
+    cert: {{ file "files/cert.pem" | base64 }}
+    cert_sha: {{ file "files/cert.pem" | sha256 }}
+    meta: '{{ toJson $services }}'
+policies:
+{{- range $services }}
+  - name: {{ . }}
+    type: client
+    rules: |
+{{ printf "key \"services/%s/\" {\n  policy = \"read\"\n}" . | indent 6 }}
+{{- end }}
+`,
+				"files/cert.pem": "CERT",
+			})
+			So(err, ShouldBeNil)
+			flat, err := flattenKV(rules.KeyValue)
+			So(err, ShouldBeNil)
+			So(flat["services/api/env"], ShouldEqual, "prod")
+			So(flat["services/web/env"], ShouldEqual, "prod")
+			So(flat["services/cert"], ShouldEqual, "Q0VSVA==")
+			So(flat["services/cert_sha"], ShouldEqual, fmt.Sprintf("%x", sha256.Sum256([]byte("CERT"))))
+			So(flat["services/meta"], ShouldEqual, `["api","web"]`)
+			So(len(rules.Policies), ShouldEqual, 2)
+			So(rules.Policies[1].Rules, ShouldEqual, "key \"services/web/\" {\n  policy = \"read\"\n}\n")
+		})
+
+		Convey("Template errors point at the template line", func() {
+			_, err := load(map[string]string{"bad.yml.tmpl": "kv:\n  a: b\n  c: {{ .Missing }}\n"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "bad.yml.tmpl:3")
+		})
+	})
+}
+
+func TestRuleFormats(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	Convey("Loading rules of every format", t, func() {
+		formats := map[string]string{
+			"rules.yml": `
+kv:
+  top: level
+  port: 8500
+  app/:
+    name: app
+    db:
+      host: localhost
+    legacy/: ${ignore}
+policies:
+  - name: app
+    type: client
+    rules: |
+      key "app/" { policy = "read" }
+acl_tokens:
+  - description: app token
+    policies: [app]
+`,
+			"rules.json": `{
+  "kv": {
+    "top": "level",
+    "port": 8500,
+    "app/": {"name": "app", "db": {"host": "localhost"}, "legacy/": "${ignore}"}
+  },
+  "policies": [
+    {"name": "app", "type": "client", "rules": "key \"app/\" { policy = \"read\" }\n"}
+  ],
+  "acl_tokens": [{"description": "app token", "policies": ["app"]}]
+}`,
+			"rules.hcl": `
+kv {
+  top = "level"
+  port = 8500
+  "app/" {
+    name = "app"
+    db {
+      host = "localhost"
+    }
+    "legacy/" = "${ignore}"
+  }
+}
+policies = [
+  {
+    name = "app"
+    type = "client"
+    rules = <<EOF
+key "app/" { policy = "read" }
+EOF
+  },
+]
+acl_tokens {
+  description = "app token"
+  policies = ["app"]
+}
+`,
+			"rules.toml": `
+[kv]
+top = "level"
+port = 8500
+
+[kv."app/"]
+name = "app"
+"legacy/" = "${ignore}"
+
+[kv."app/".db]
+host = "localhost"
+
+[[policies]]
+name = "app"
+type = "client"
+rules = """
+key "app/" { policy = "read" }
+"""
+
+[[acl_tokens]]
+description = "app token"
+policies = ["app"]
+`,
+		}
+
+		for name, content := range formats {
+			name, content := name, content
+			Convey("Format "+filepath.Ext(name)+" is decoded like YAML", func() {
+				dir := writeRules(map[string]string{name: content})
+				defer os.RemoveAll(dir)
+				rules := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+				So(loadFile(filepath.Join(dir, name), &rules), ShouldBeNil)
+
+				flat, err := flattenKV(rules.KeyValue)
+				So(err, ShouldBeNil)
+				So(flat, ShouldResemble, map[string]interface{}{
+					"top":         "level",
+					"port":        "8500",
+					"app/name":    "app",
+					"app/db/host": "localhost",
+					"app/legacy/": "${ignore}",
+				})
+				So(rules.Policies, ShouldResemble, acls{{Name: "app", Type: "client", Rules: "key \"app/\" { policy = \"read\" }\n"}})
+				So(len(rules.AclTokens), ShouldEqual, 1)
+				So(rules.AclTokens[0].Description, ShouldEqual, "app token")
+				So(rules.AclTokens[0].Policies, ShouldResemble, []string{"app"})
+
+				changes := []kvChange{}
+				So(planTree(&rules.KeyValue, kvScope{""}, map[string]*consulapi.KVPair{}, &changes), ShouldBeNil)
+				So(len(changes), ShouldEqual, 5)
+			})
+		}
+
+		Convey("Services with meta and checks are decoded from HCL", func() {
+			dir := writeRules(map[string]string{"services.hcl": `
+services {
+  name = "web"
+  port = 80
+  tags = ["a"]
+  meta {
+    team = "web"
+    tier = "front"
+  }
+  checks {
+    name = "http"
+    http = "http://localhost/health"
+    interval = "10s"
+  }
+}
+`})
+			defer os.RemoveAll(dir)
+			rules := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+			So(loadFile(filepath.Join(dir, "services.hcl"), &rules), ShouldBeNil)
+			So(rules.Services, ShouldResemble, []service{{
+				Name:   "web",
+				Port:   80,
+				Tags:   []string{"a"},
+				Meta:   map[string]string{"team": "web", "tier": "front"},
+				Checks: []serviceCheck{{Name: "http", HTTP: "http://localhost/health", Interval: "10s"}},
+			}})
+		})
+
+		Convey("The default patterns load every format", func() {
+			dir := writeRules(map[string]string{"a.json": "{}", "b.hcl": "", "c.toml": "", "d.yml": "", "e.txt": ""})
+			defer os.RemoveAll(dir)
+			files, err := ruleFiles(dir)
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 4)
+		})
+	})
+}
+
+func TestFileValues(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	Convey("Loading values from files", t, func() {
+		defer func() { config.Conf = config.Config{} }()
+		config.Conf.Variables = map[string]string{"dc": "dc1"}
+
+		dir := writeRules(map[string]string{
+			"team/rules.yml": "kv:\n  app/:\n    cert: ${file:files/${var.dc}.pem}\n    config: ${dir:files/config}\n" +
+				"policies:\n  - name: app\n    rules: ${file:files/app.hcl}\n",
+			"team/files/dc1.pem":              "-----BEGIN CERTIFICATE-----\n${not a variable}\n",
+			"team/files/app.hcl":              "key \"app/\" { policy = \"read\" }\n",
+			"team/files/config/app.json":      "{\"debug\": false}",
+			"team/files/config/nested/db.ini": "host=localhost\n",
+			"team/files/config/.hidden":       "skipped",
+		})
+		defer os.RemoveAll(dir)
+
+		load := func(name string) (*consulConfig, error) {
+			rules := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+			err := loadFile(filepath.Join(dir, name), &rules)
+			return &rules, err
+		}
+
+		Convey("File references are replaced by the content of the files", func() {
+			rules, err := load("team/rules.yml")
+			So(err, ShouldBeNil)
+			flat, err := flattenKV(rules.KeyValue)
+			So(err, ShouldBeNil)
+			So(flat, ShouldResemble, map[string]interface{}{
+				"app/cert":                 "-----BEGIN CERTIFICATE-----\n${not a variable}\n",
+				"app/config/app.json":      "{\"debug\": false}",
+				"app/config/nested/db.ini": "host=localhost\n",
+			})
+		})
+
+		Convey("References are only read in the KV trees", func() {
+			rules, err := load("team/rules.yml")
+			So(err, ShouldBeNil)
+			So(rules.Policies[0].Rules, ShouldEqual, "${file:files/app.hcl}")
+		})
+
+		Convey("The mirrored files are compared with the stored values", func() {
+			rules, err := load("team/rules.yml")
+			So(err, ShouldBeNil)
+			current := map[string]*consulapi.KVPair{
+				"app/cert":                 {Key: "app/cert", Value: []byte("-----BEGIN CERTIFICATE-----\n${not a variable}\n")},
+				"app/config/app.json":      {Key: "app/config/app.json", Value: []byte("{\"debug\": true}"), ModifyIndex: 7},
+				"app/config/nested/db.ini": {Key: "app/config/nested/db.ini", Value: []byte("host=localhost\n")},
+				"app/config/removed":       {Key: "app/config/removed", Value: []byte("stale")},
+			}
+			changes := []kvChange{}
+			So(planTree(&rules.KeyValue, kvScope{""}, current, &changes), ShouldBeNil)
+			So(changes, ShouldResemble, []kvChange{{Action: actionUpdate, Key: "app/config/app.json", Value: "{\"debug\": false}", OldValue: "{\"debug\": true}", ModifyIndex: 7}})
+			So(current, ShouldContainKey, "app/config/removed")
+		})
+
+		Convey("A missing file names the rule file and the key", func() {
+			dir := writeRules(map[string]string{"rules.yml": "kv:\n  cert: ${file:missing.pem}\n"})
+			defer os.RemoveAll(dir)
+			rules := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+			err := loadFile(filepath.Join(dir, "rules.yml"), &rules)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `kv["cert"]`)
+			So(err.Error(), ShouldContainSubstring, "rules.yml")
+		})
+	})
+}
+
+func TestBase64Values(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	Convey("Loading binary values", t, func() {
+		dir := writeRules(map[string]string{
+			"rules.yml":   "kv:\n  app/:\n    folded: ${base64:yv4A\n      /w==}\n    tagged: !!binary yv4A/w==\n",
+			"rules.json":  `{"kv": {"json": "${base64:yv4A/w==}"}}`,
+			"invalid.yml": "kv:\n  bad: ${base64:not base64!}\n",
+		})
+		defer os.RemoveAll(dir)
+
+		load := func(name string) (*consulConfig, error) {
+			rules := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+			err := loadFile(filepath.Join(dir, name), &rules)
+			return &rules, err
+		}
+		binary := string([]byte{0xca, 0xfe, 0x00, 0xff})
+
+		Convey("base64 values and !!binary are decoded to raw bytes", func() {
+			rules, err := load("rules.yml")
+			So(err, ShouldBeNil)
+			flat, err := flattenKV(rules.KeyValue)
+			So(err, ShouldBeNil)
+			So(flat, ShouldResemble, map[string]interface{}{"app/folded": binary, "app/tagged": binary})
+
+			rules, err = load("rules.json")
+			So(err, ShouldBeNil)
+			So(rules.KeyValue["json"], ShouldEqual, binary)
+		})
+
+		Convey("Binary values stay raw bytes when layers are merged", func() {
+			base := writeRules(map[string]string{"kv.yml": "kv:\n  app/:\n    blob: ${base64:yv4A/w==}\n    name: app\n"})
+			defer os.RemoveAll(base)
+			prod := writeRules(map[string]string{"kv.yml": "kv:\n  app/:\n    name: prod\n  extra: ${delete}\n"})
+			defer os.RemoveAll(prod)
+
+			rules := ImportLayers([]string{base, prod})
+			flat, err := flattenKV(rules.KeyValue)
+			So(err, ShouldBeNil)
+			So(flat, ShouldResemble, map[string]interface{}{"app/blob": binary, "app/name": "prod"})
+
+			changes := []kvChange{}
+			So(planTree(&rules.KeyValue, kvScope{""}, map[string]*consulapi.KVPair{}, &changes), ShouldBeNil)
+			for _, change := range changes {
+				if change.Key == "app/blob" {
+					So(change.Value, ShouldEqual, binary)
+				}
+			}
+		})
+
+		Convey("Invalid base64 names the key", func() {
+			_, err := load("invalid.yml")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `kv["bad"]`)
+		})
+	})
+}
+
+func TestJSONValues(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	Convey("Storing structures as JSON values", t, func() {
+		dir := writeRules(map[string]string{
+			"rules.yml": "kv:\n  app/:\n    config:\n      ${json}:\n        hosts: [b, a]\n        debug: true\n        limits: {max: 10, ratio: 0.5}\n" +
+				"        html: <a&b>\n  list:\n    ${json}: [1, two]\n",
+			"mixed.yml": "kv:\n  app/:\n    config:\n      ${json}: {}\n      other: value\n",
+		})
+		defer os.RemoveAll(dir)
+
+		load := func(name string) (*consulConfig, error) {
+			rules := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+			err := loadFile(filepath.Join(dir, name), &rules)
+			return &rules, err
+		}
+
+		Convey("A wrapped structure is a single key with canonical JSON", func() {
+			rules, err := load("rules.yml")
+			So(err, ShouldBeNil)
+			flat, err := flattenKV(rules.KeyValue)
+			So(err, ShouldBeNil)
+			So(flat, ShouldResemble, map[string]interface{}{
+				"app/config": jsonValue(`{"debug":true,"hosts":["b","a"],"html":"<a&b>","limits":{"max":10,"ratio":0.5}}`),
+				"list":       jsonValue(`[1,"two"]`),
+			})
+		})
+
+		Convey("Stored JSON is compared semantically", func() {
+			rules, err := load("rules.yml")
+			So(err, ShouldBeNil)
+			current := map[string]*consulapi.KVPair{
+				"app/config": {Key: "app/config", Value: []byte("{\n  \"limits\": {\"ratio\": 0.50, \"max\": 10},\n  \"html\": \"<a&b>\",\n  \"hosts\": [\"b\", \"a\"],\n  \"debug\": true\n}")},
+				"list":       {Key: "list", Value: []byte(`["two", 1]`), ModifyIndex: 3},
+			}
+			changes := []kvChange{}
+			So(planTree(&rules.KeyValue, kvScope{""}, current, &changes), ShouldBeNil)
+			So(changes, ShouldResemble, []kvChange{{Action: actionUpdate, Key: "list", Value: `[1,"two"]`, OldValue: `["two", 1]`, ModifyIndex: 3}})
+			So(current, ShouldBeEmpty)
+		})
+
+		Convey("Other keys next to the wrapper are an error", func() {
+			_, err := load("mixed.yml")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "app/config")
+			problems, _ := validateFile(filepath.Join(dir, "mixed.yml"))
+			So(problems, ShouldHaveLength, 1)
+			problems, _ = validateFile(filepath.Join(dir, "rules.yml"))
+			So(problems, ShouldBeEmpty)
+		})
+
+		Convey("Rendered rules keep the wrapper", func() {
+			rules, err := load("rules.yml")
+			So(err, ShouldBeNil)
+			rendered, err := yaml.Marshal(rules)
+			So(err, ShouldBeNil)
+			reloaded := writeRules(map[string]string{"rules.yml": string(rendered)})
+			defer os.RemoveAll(reloaded)
+			again := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+			So(loadFile(filepath.Join(reloaded, "rules.yml"), &again), ShouldBeNil)
+			So(again.KeyValue, ShouldResemble, rules.KeyValue)
+		})
+	})
+}
+
+func TestKVFlags(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	Convey("Declaring the flags of keys", t, func() {
+		dir := writeRules(map[string]string{
+			"rules.yml": "kv:\n  app/:\n    schema:\n      ${value}: v2\n      ${flags}: 42\n    config:\n      ${json}: {debug: true}\n      ${flags}: 7\n    plain: text\n",
+			"bad.yml":   "kv:\n  app/:\n    schema:\n      ${value}: v2\n      ${flags}: -1\n",
+		})
+		defer os.RemoveAll(dir)
+
+		load := func(name string) (*consulConfig, error) {
+			rules := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+			err := loadFile(filepath.Join(dir, name), &rules)
+			return &rules, err
+		}
+
+		Convey("Values are declared with their flags", func() {
+			rules, err := load("rules.yml")
+			So(err, ShouldBeNil)
+			flat, err := flattenKV(rules.KeyValue)
+			So(err, ShouldBeNil)
+			So(flat, ShouldResemble, map[string]interface{}{
+				"app/schema": flaggedValue{value: "v2", flags: 42},
+				"app/config": flaggedValue{value: jsonValue(`{"debug":true}`), flags: 7},
+				"app/plain":  "text",
+			})
+		})
+
+		Convey("Flags are compared like values", func() {
+			rules, err := load("rules.yml")
+			So(err, ShouldBeNil)
+			current := map[string]*consulapi.KVPair{
+				"app/schema": {Key: "app/schema", Value: []byte("v2"), Flags: 41, ModifyIndex: 5},
+				"app/config": {Key: "app/config", Value: []byte(`{ "debug": true }`), Flags: 7},
+				"app/plain":  {Key: "app/plain", Value: []byte("text"), Flags: 3, ModifyIndex: 6},
+			}
+			changes := []kvChange{}
+			So(planTree(&rules.KeyValue, kvScope{""}, current, &changes), ShouldBeNil)
+			sort.Sort(byKey(changes))
+			So(changes, ShouldResemble, []kvChange{
+				{Action: actionUpdate, Key: "app/plain", Value: "text", OldValue: "text", OldFlags: 3, ModifyIndex: 6},
+				{Action: actionUpdate, Key: "app/schema", Value: "v2", OldValue: "v2", Flags: 42, OldFlags: 41, ModifyIndex: 5},
+			})
+
+			var out bytes.Buffer
+			(&plan{KeyValues: changes}).Print(&out)
+			So(out.String(), ShouldContainSubstring, `~ app/schema = "v2" => "v2" (flags 41 => 42)`)
+		})
+
+		Convey("Exported flags plan no changes", func() {
+			current := map[string]*consulapi.KVPair{
+				"app/schema": {Key: "app/schema", Value: []byte("v2"), Flags: 42},
+				"app/plain":  {Key: "app/plain", Value: []byte("text")},
+			}
+			rendered, err := yaml.Marshal(&consulConfig{KeyValue: buildKVTree(current)})
+			So(err, ShouldBeNil)
+			exported := writeRules(map[string]string{"kv.yml": string(rendered)})
+			defer os.RemoveAll(exported)
+
+			rules := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+			So(loadFile(filepath.Join(exported, "kv.yml"), &rules), ShouldBeNil)
+			changes := []kvChange{}
+			So(planTree(&rules.KeyValue, kvScope{""}, current, &changes), ShouldBeNil)
+			So(changes, ShouldBeEmpty)
+		})
+
+		Convey("Invalid flags are an error", func() {
+			_, err := load("bad.yml")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Invalid flags of key 'app/schema'")
+		})
+	})
+}
@@ -0,0 +1,153 @@
+// +build integration
+
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"bytes"
+	"config2consul/config"
+	"config2consul/log"
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func findKVChange(changes *plan, key string) kvChange {
+	for _, change := range changes.KeyValues {
+		if change.Key == key {
+			return change
+		}
+	}
+	return kvChange{}
+}
+
+func TestPlan(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	consul, deferFn, err := createTestProject("../testing/integration/consul_base/docker-compose.yml", "ssl/ca.crt", "ssl/consul_client.crt", "ssl/consul_client.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deferFn()
+
+	Convey("Planning changes", t, func() {
+		config.Conf.PreserveBuiltInTokens = true
+
+		Convey("A plan doesn't write to Consul", func() {
+			CreateKV(t, consul, "plan/changed", []byte("old"))
+			CreateKV(t, consul, "plan/runaway", []byte("foo"))
+			CreateACL(t, consul, "plan unexpected", "client", "# unexpected")
+
+			configData := consulConfig{
+				Policies: acls{
+					acl{
+						Name:  "plan new",
+						Rules: "# new",
+					},
+				},
+				KeyValue: map[string]interface{}{
+					"plan/new":     "value",
+					"plan/changed": "new",
+				},
+			}
+			changes, err := consul.planConfig(&configData)
+			So(err, ShouldBeNil)
+			So(changes.HasChanges(), ShouldBeTrue)
+
+			So(findKVChange(changes, "plan/new").Action, ShouldEqual, actionCreate)
+			So(findKVChange(changes, "plan/changed").Action, ShouldEqual, actionUpdate)
+			So(findKVChange(changes, "plan/changed").ModifyIndex, ShouldEqual, GetValue(t, consul, "plan/changed").ModifyIndex)
+			So(findKVChange(changes, "plan/runaway").Action, ShouldEqual, actionDelete)
+
+			So(GetValue(t, consul, "plan/new"), ShouldBeNil)
+			So(string(GetValue(t, consul, "plan/changed").Value), ShouldEqual, "old")
+			So(GetValue(t, consul, "plan/runaway"), ShouldNotBeNil)
+			So(GetAclByName(t, consul, "plan new"), ShouldBeNil)
+			So(GetAclByName(t, consul, "plan unexpected"), ShouldNotBeNil)
+
+			var out bytes.Buffer
+			changes.Print(&out)
+			So(out.String(), ShouldContainSubstring, `+ plan/new = "value"`)
+			So(out.String(), ShouldContainSubstring, `~ plan/changed = "old" => "new"`)
+			So(out.String(), ShouldContainSubstring, `- plan/runaway (was "foo")`)
+			So(out.String(), ShouldContainSubstring, "- plan unexpected [client]")
+		})
+
+		Convey("An applied plan leaves nothing to change", func() {
+			configData := consulConfig{
+				Policies: acls{
+					acl{
+						Name:  "plan new",
+						Rules: "# new",
+					},
+				},
+				KeyValue: map[string]interface{}{
+					"plan/new": "value",
+					"ignored/": "${ignore}",
+				},
+			}
+			err := importConfig(consul, &configData)
+			So(err, ShouldBeNil)
+
+			changes, err := consul.planConfig(&configData)
+			So(err, ShouldBeNil)
+			So(changes.HasChanges(), ShouldBeFalse)
+			So(findKVChange(changes, "ignored/").Action, ShouldEqual, actionIgnore)
+		})
+
+		Convey("A saved plan is applied exactly", func() {
+			configData := consulConfig{
+				KeyValue: map[string]interface{}{
+					"saved/key": "planned",
+				},
+			}
+			changes, err := consul.planConfig(&configData)
+			So(err, ShouldBeNil)
+
+			path := filepath.Join(os.TempDir(), "config2consul_plan_test.json")
+			defer os.Remove(path)
+			So(changes.Save(path), ShouldBeNil)
+			So(IsPlanFile(path), ShouldBeTrue)
+
+			loaded, err := LoadPlan(path)
+			So(err, ShouldBeNil)
+			So(loaded, ShouldResemble, changes)
+
+			So(consul.verifyPlan(loaded), ShouldBeNil)
+			So(consul.applyPlan(loaded), ShouldBeNil)
+			So(string(GetValue(t, consul, "saved/key").Value), ShouldEqual, "planned")
+		})
+
+		Convey("A stale plan is refused", func() {
+			CreateKV(t, consul, "stale/key", []byte("old"))
+			configData := consulConfig{
+				KeyValue: map[string]interface{}{
+					"stale/key": "planned",
+				},
+			}
+			changes, err := consul.planConfig(&configData)
+			So(err, ShouldBeNil)
+
+			CreateKV(t, consul, "stale/key", []byte("changed meanwhile"))
+
+			So(consul.verifyPlan(changes), ShouldNotBeNil)
+			So(string(GetValue(t, consul, "stale/key").Value), ShouldEqual, "changed meanwhile")
+		})
+	})
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// jsonWrapper is the only key of a map stored as a single JSON encoded value
+// instead of a tree:
+//
+//	config:
+//	  ${json}: {debug: true, hosts: [a, b]}
+const jsonWrapper = "${json}"
+
+// jsonValue is a KV value declared as a structure and stored as canonical
+// JSON. It is compared with the stored value semantically.
+type jsonValue string
+
+// MarshalYAML writes the value back with the wrapper, so rendered rules
+// still compare semantically
+func (value jsonValue) MarshalYAML() (interface{}, error) {
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{jsonWrapper: decoded}, nil
+}
+
+// wrapValues replaces the maps declaring a single value in the KV trees (with
+// the jsonWrapper, valueKey or flagsKey keys) with their values
+func (consConf *consulConfig) wrapValues() error {
+	for key, value := range consConf.KeyValue {
+		wrapped, err := wrapValue(value, key)
+		if err != nil {
+			return err
+		}
+		consConf.KeyValue[key] = wrapped
+	}
+	return nil
+}
+
+func wrapValue(value interface{}, path string) (interface{}, error) {
+	switch tree := value.(type) {
+	case map[interface{}]interface{}:
+		_, hasValue := tree[valueKey]
+		if _, hasFlags := tree[flagsKey]; hasFlags || hasValue {
+			return newFlaggedValue(jsonCompatible(tree).(map[string]interface{}), path)
+		}
+		if inner, ok := tree[jsonWrapper]; ok {
+			return newJSONValue(inner, path, len(tree))
+		}
+		for key, item := range tree {
+			wrapped, err := wrapValue(item, fmt.Sprintf("%s/%v", strings.TrimSuffix(path, "/"), key))
+			if err != nil {
+				return nil, err
+			}
+			tree[key] = wrapped
+		}
+	case map[string]interface{}:
+		_, hasValue := tree[valueKey]
+		if _, hasFlags := tree[flagsKey]; hasFlags || hasValue {
+			return newFlaggedValue(tree, path)
+		}
+		if inner, ok := tree[jsonWrapper]; ok {
+			return newJSONValue(inner, path, len(tree))
+		}
+		for key, item := range tree {
+			wrapped, err := wrapValue(item, strings.TrimSuffix(path, "/")+"/"+key)
+			if err != nil {
+				return nil, err
+			}
+			tree[key] = wrapped
+		}
+	}
+	return value, nil
+}
+
+func newJSONValue(inner interface{}, path string, keys int) (jsonValue, error) {
+	if keys != 1 {
+		return "", fmt.Errorf("Key '%s' has other keys next to '%s'", path, jsonWrapper)
+	}
+	encoded, err := canonicalJSON(inner)
+	if err != nil {
+		return "", fmt.Errorf("Can't encode the value of key '%s' as JSON. %v", path, err)
+	}
+	return jsonValue(encoded), nil
+}
+
+// canonicalJSON encodes a structure with sorted keys and without insignificant
+// whitespace. The structure is encoded twice, so numbers are formatted the
+// same way as in a decoded stored value.
+func canonicalJSON(value interface{}) (string, error) {
+	encoded, err := marshalJSON(jsonCompatible(value))
+	if err != nil {
+		return "", err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return "", err
+	}
+	encoded, err = marshalJSON(decoded)
+	return string(encoded), err
+}
+
+func marshalJSON(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buffer.Bytes(), "\n"), nil
+}
+
+// jsonCompatible converts the maps decoded from YAML to maps with string keys
+func jsonCompatible(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{})
+		for key, item := range value {
+			converted[fmt.Sprint(key)] = jsonCompatible(item)
+		}
+		return converted
+	case map[string]interface{}:
+		converted := make(map[string]interface{})
+		for key, item := range value {
+			converted[key] = jsonCompatible(item)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(value))
+		for i, item := range value {
+			converted[i] = jsonCompatible(item)
+		}
+		return converted
+	default:
+		return value
+	}
+}
+
+// sameJSON reports whether a stored value is the same structure as a
+// declared JSON value, regardless of formatting and key order
+func sameJSON(stored string, declared jsonValue) bool {
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(stored), &decoded); err != nil {
+		return false
+	}
+	canonical, err := canonicalJSON(decoded)
+	return err == nil && canonical == string(declared)
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2consul/log"
+	"fmt"
+	"strings"
+)
+
+// deleteValue removes an inherited key, or a whole inherited tree, in an
+// overlay layer
+const deleteValue = "${delete}"
+
+// ImportLayers loads every path as a layer and merges the layers in order.
+// Later layers override the keys and ACLs of the earlier ones.
+func ImportLayers(paths []string) *consulConfig {
+	merged := ImportPath(paths[0])
+	for _, path := range paths[1:] {
+		log.Info("Merging layer: " + path)
+		if err := merged.mergeLayer(ImportPath(path)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := merged.dropDeletes(); err != nil {
+		log.Fatal(err)
+	}
+	return merged
+}
+
+// mergeLayer deep merges an overlay layer into the rules. Keys are merged one
+// by one rather than by top level trees, and ACLs with the same name are
+// replaced.
+func (consConf *consulConfig) mergeLayer(layer *consulConfig) error {
+	for _, entry := range layer.Policies {
+		consConf.putPolicy(entry)
+	}
+	for _, entry := range layer.AclPolicies {
+		consConf.putAclPolicy(entry)
+	}
+	for _, entry := range layer.AclRoles {
+		consConf.putAclRole(entry)
+	}
+	for _, entry := range layer.AclTokens {
+		consConf.putAclToken(entry)
+	}
+	for _, entry := range layer.Services {
+		consConf.putService(entry)
+	}
+	consConf.ManagedPrefixes = append(consConf.ManagedPrefixes, layer.ManagedPrefixes...)
+	consConf.Ignore.merge(layer.Ignore)
+
+	base, err := flattenKV(consConf.KeyValue)
+	if err != nil {
+		return err
+	}
+	overlay, err := flattenKV(layer.KeyValue)
+	if err != nil {
+		return err
+	}
+	for key, value := range overlay {
+		if value == deleteValue {
+			deleted := 0
+			for inherited := range base {
+				if inherited == key || (strings.HasSuffix(key, "/") && strings.HasPrefix(inherited, key)) {
+					delete(base, inherited)
+					deleted++
+				}
+			}
+			log.Infof("Layer deletes %d inherited key(s) of '%s'", deleted, key)
+			continue
+		}
+		base[key] = value
+	}
+	consConf.KeyValue = unflattenKV(base)
+	return nil
+}
+
+// dropDeletes removes the deletions which had nothing to delete in the
+// layers below them
+func (consConf *consulConfig) dropDeletes() error {
+	flat, err := flattenKV(consConf.KeyValue)
+	if err != nil {
+		return err
+	}
+	dropped := false
+	for key, value := range flat {
+		if value == deleteValue {
+			log.Warningf("Nothing to delete for key '%s'", key)
+			delete(flat, key)
+			dropped = true
+		}
+	}
+	if dropped {
+		consConf.KeyValue = unflattenKV(flat)
+	}
+	return nil
+}
+
+// flattenKV returns the value of every key of the trees by its full path. An
+// ignored or deleted tree is kept as a key ending with a '/'. The values are
+// strings, JSON values or values with flags.
+func flattenKV(keyValue map[string]interface{}) (map[string]interface{}, error) {
+	flat := make(map[string]interface{})
+	err := flattenTree(&keyValue, flat)
+	return flat, err
+}
+
+func flattenTree(keyValue *map[string]interface{}, flat map[string]interface{}) error {
+	for key, i_value := range *keyValue {
+		if strings.HasSuffix(key, "/") {
+			switch value := i_value.(type) {
+			case string:
+				flat[key] = value
+			case map[interface{}]interface{}:
+				if err := flattenTree(convert_map(&value, key), flat); err != nil {
+					return err
+				}
+			case map[string]interface{}:
+				if err := flattenTree(prefix_map(value, key), flat); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("Unexpected value for the key tree '%s' of type: %T", key, i_value)
+			}
+			continue
+		}
+
+		switch value := i_value.(type) {
+		case jsonValue, flaggedValue:
+			flat[key] = value
+			continue
+		}
+		str_value, ok := get_string_value(i_value)
+		if !ok {
+			return fmt.Errorf("Unexpected value for the key '%s': %T", key, i_value)
+		}
+		flat[key] = str_value
+	}
+	return nil
+}
+
+// unflattenKV nests the keys into trees again. Ignored and deleted trees, and
+// values with JSON or flags, stay at the top level. The values are kept as
+// they are, so binary values stay raw bytes.
+func unflattenKV(flat map[string]interface{}) map[string]interface{} {
+	values := make(map[string]interface{})
+	markers := make(map[string]interface{})
+	for key, i_value := range flat {
+		value, ok := i_value.(string)
+		if !ok || (strings.HasSuffix(key, "/") && value != "") {
+			markers[key] = i_value
+			continue
+		}
+		values[key] = value
+	}
+
+	tree := nestKV(values)
+	for key, value := range markers {
+		tree[key] = value
+	}
+	return tree
+}
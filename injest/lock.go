@@ -0,0 +1,97 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2consul/config"
+	"config2consul/log"
+	consulapi "github.com/hashicorp/consul/api"
+	"time"
+)
+
+// defaultLockKey is the key of the lock held while converging, unless the
+// config file sets lock_key
+const defaultLockKey = "config2consul/lock"
+
+// lockTryTime is how long a contender which doesn't wait for the lock tries
+// to acquire it before skipping the run
+const lockTryTime = time.Second
+
+func lockKey() string {
+	if config.Conf.LockKey != "" {
+		return config.Conf.LockKey
+	}
+	return defaultLockKey
+}
+
+// withLock runs converge while holding the session based lock, so only one
+// config2consul instance writes to Consul at a time. If another instance holds
+// the lock, withLock either waits for it or skips converge, depending on the
+// -lock-wait flag. Closing stop gives up waiting, converge is skipped then.
+func (consul *consulClient) withLock(stop <-chan struct{}, converge func() error) error {
+	key := lockKey()
+	lock, err := consul.Client.LockOpts(&consulapi.LockOptions{
+		Key:          key,
+		SessionName:  "config2consul",
+		LockTryOnce:  !config.Conf.LockWait,
+		LockWaitTime: lockTryTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	if config.Conf.LockWait {
+		log.Infof("Waiting for the lock '%s'", key)
+	}
+	lost, err := lock.Lock(stop)
+	if err != nil {
+		log.Errorf("Failed to acquire the lock '%s'. %v", key, err)
+		return err
+	}
+	if lost == nil && stopped(stop) {
+		log.Infof("Stopped waiting for the lock '%s'", key)
+		return nil
+	}
+	if lost == nil {
+		log.Warningf("Another config2consul instance holds the lock '%s'. Skipping.", key)
+		return nil
+	}
+	log.Debugf("Acquired the lock '%s'", key)
+	defer func() {
+		if err := lock.Unlock(); err != nil {
+			log.Errorf("Failed to release the lock '%s'. %v", key, err)
+		}
+	}()
+
+	err = converge()
+	select {
+	case <-lost:
+		log.Warningf("Lost the lock '%s' while converging", key)
+	default:
+	}
+	return err
+}
+
+// stopped returns true if stop is closed. A nil stop is never closed.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
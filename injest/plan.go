@@ -0,0 +1,594 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2consul/config"
+	"config2consul/log"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	consulapi "github.com/hashicorp/consul/api"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// Actions that can be recorded for an item in a plan
+const (
+	actionCreate = "create"
+	actionUpdate = "update"
+	actionDelete = "delete"
+	actionIgnore = "ignore"
+)
+
+// planFormatVersion is the version of the saved plan file format. Version 2
+// saves binary values in base64.
+const planFormatVersion = 2
+
+// base64Encoding marks a saved kvChange with values in base64
+const base64Encoding = "base64"
+
+// kvChange holds the ModifyIndex the key had when it was planned (0 if the key
+// didn't exist) to detect if the key was changed before the plan is applied.
+type kvChange struct {
+	Action      string `json:"action"`
+	Key         string `json:"key"`
+	Value       string `json:"value,omitempty"`
+	OldValue    string `json:"old_value,omitempty"`
+	Flags       uint64 `json:"flags,omitempty"`
+	OldFlags    uint64 `json:"old_flags,omitempty"`
+	ModifyIndex uint64 `json:"modify_index,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// savedKVChange is a kvChange without its JSON methods
+type savedKVChange kvChange
+
+// jsonKVChange is the saved form of a kvChange. JSON strings can't hold
+// values which aren't valid UTF-8, so both values are then saved in base64.
+type jsonKVChange struct {
+	savedKVChange
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func (change kvChange) MarshalJSON() ([]byte, error) {
+	saved := jsonKVChange{savedKVChange: savedKVChange(change)}
+	if !utf8.ValidString(change.Value) || !utf8.ValidString(change.OldValue) {
+		saved.Encoding = base64Encoding
+		saved.Value = base64.StdEncoding.EncodeToString([]byte(change.Value))
+		saved.OldValue = base64.StdEncoding.EncodeToString([]byte(change.OldValue))
+	}
+	return json.Marshal(saved)
+}
+
+func (change *kvChange) UnmarshalJSON(data []byte) error {
+	var saved jsonKVChange
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	switch saved.Encoding {
+	case "":
+	case base64Encoding:
+		value, err := base64.StdEncoding.DecodeString(saved.Value)
+		if err != nil {
+			return fmt.Errorf("Invalid value of key '%s'. %v", saved.Key, err)
+		}
+		oldValue, err := base64.StdEncoding.DecodeString(saved.OldValue)
+		if err != nil {
+			return fmt.Errorf("Invalid old value of key '%s'. %v", saved.Key, err)
+		}
+		saved.Value, saved.OldValue = string(value), string(oldValue)
+	default:
+		return fmt.Errorf("Unknown encoding '%s' of key '%s'", saved.Encoding, saved.Key)
+	}
+	*change = kvChange(saved.savedKVChange)
+	return nil
+}
+
+// aclChange holds the ID and ModifyIndex of the existing ACL (if any) to
+// detect if the ACL was changed before the plan is applied.
+type aclChange struct {
+	Action      string `json:"action"`
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Type        string `json:"type,omitempty"`
+	Rules       string `json:"rules,omitempty"`
+	OldType     string `json:"old_type,omitempty"`
+	OldRules    string `json:"old_rules,omitempty"`
+	ModifyIndex uint64 `json:"modify_index,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// plan is the complete changeset required to converge Consul to the rules.
+// Computing a plan never writes to Consul. ManagedKeys, ManagedAcls and
+// ManagedServices are the number of items that existed in Consul when the plan
+// was computed.
+type plan struct {
+	FormatVersion   int               `json:"format_version"`
+	KeyValues       []kvChange        `json:"kv,omitempty"`
+	Policies        []aclChange       `json:"policies,omitempty"`
+	ACLObjects      []aclObjectChange `json:"acl_objects,omitempty"`
+	Services        []serviceChange   `json:"services,omitempty"`
+	ManagedKeys     int               `json:"managed_keys"`
+	ManagedAcls     int               `json:"managed_acls"`
+	ManagedServices int               `json:"managed_services,omitempty"`
+}
+
+// planConfig computes the changes needed for Consul to match the config
+func (consul *consulClient) planConfig(config *consulConfig) (*plan, error) {
+	changes := plan{FormatVersion: planFormatVersion}
+
+	if len(config.Policies) > 0 {
+		if err := consul.planPolicies(&config.Policies, &changes); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Info("No ACLs to import.")
+	}
+	if len(config.AclPolicies)+len(config.AclRoles)+len(config.AclTokens) > 0 {
+		if err := consul.planAclSystem(config, &changes); err != nil {
+			return nil, err
+		}
+	}
+	if len(config.KeyValue) > 0 {
+		if err := consul.planKeyValue(&config.KeyValue, config.managedScope(), &changes); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Info("No KVs to import.")
+	}
+	if len(config.Services) > 0 {
+		if err := consul.planServices(config.Services, &changes); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := changes.applyIgnore(&config.Ignore); err != nil {
+		return nil, err
+	}
+	return &changes, nil
+}
+
+// applyPlan executes all the changes of the plan against Consul. A failing
+// section doesn't stop the others: ACLs, keys and services are all attempted
+// and the failures are reported together.
+func (consul *consulClient) applyPlan(changes *plan) error {
+	failures := []string{}
+
+	failed := 0
+	for _, change := range changes.Policies {
+		if _, err := consul.applyAclChange(&change); err != nil {
+			failed++
+		}
+	}
+	for _, change := range changes.ACLObjects {
+		if _, err := consul.applyAclObjectChange(&change); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		failures = append(failures, fmt.Sprintf("Failed to apply %d ACL change(s)", failed))
+	}
+
+	if err := consul.applyKVChanges(changes.KeyValues); err != nil {
+		failures = append(failures, err.Error())
+	}
+
+	failed = 0
+	for _, change := range changes.Services {
+		if err := consul.applyServiceChange(&change); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		failures = append(failures, fmt.Sprintf("Failed to apply %d service change(s)", failed))
+	}
+
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, ". "))
+	}
+	return nil
+}
+
+// verifyPlan makes sure that nothing the plan is about to change was modified
+// in Consul since the plan was computed.
+func (consul *consulClient) verifyPlan(changes *plan) error {
+	stale := []string{}
+
+	if len(changes.Policies) > 0 {
+		currentAcls, err := consul.getCurrentAcls()
+		if err != nil {
+			return err
+		}
+		currentByID := make(map[string]*consulapi.ACLEntry)
+		for _, entry := range currentAcls {
+			currentByID[entry.ID] = entry
+		}
+		for _, change := range changes.Policies {
+			switch change.Action {
+			case actionCreate:
+				if _, ok := currentAcls[change.Name]; ok {
+					stale = append(stale, fmt.Sprintf("ACL '%s' was created", change.Name))
+				}
+			case actionUpdate, actionDelete:
+				existing, ok := currentByID[change.ID]
+				if !ok {
+					stale = append(stale, fmt.Sprintf("ACL '%s' was deleted", change.Name))
+				} else if existing.ModifyIndex != change.ModifyIndex {
+					stale = append(stale, fmt.Sprintf("ACL '%s' was modified (index %d => %d)", change.Name, change.ModifyIndex, existing.ModifyIndex))
+				}
+			}
+		}
+	}
+
+	if len(changes.ACLObjects) > 0 {
+		reasons, err := consul.verifyAclObjects(changes.ACLObjects)
+		if err != nil {
+			return err
+		}
+		stale = append(stale, reasons...)
+	}
+
+	if len(changes.Services) > 0 {
+		reasons, err := consul.verifyServices(changes.Services)
+		if err != nil {
+			return err
+		}
+		stale = append(stale, reasons...)
+	}
+
+	for _, change := range changes.KeyValues {
+		if change.Action == actionIgnore {
+			continue
+		}
+		q := consulapi.QueryOptions{}
+		current, _, err := consul.Client.KV().Get(change.Key, &q)
+		if err != nil {
+			log.Errorf("Failed to get key: %s. %v", change.Key, err)
+			return err
+		}
+		switch {
+		case current == nil && change.Action != actionCreate:
+			stale = append(stale, fmt.Sprintf("Key '%s' was deleted", change.Key))
+		case current != nil && change.Action == actionCreate:
+			stale = append(stale, fmt.Sprintf("Key '%s' was created", change.Key))
+		case current != nil && current.ModifyIndex != change.ModifyIndex:
+			stale = append(stale, fmt.Sprintf("Key '%s' was modified (index %d => %d)", change.Key, change.ModifyIndex, current.ModifyIndex))
+		}
+	}
+
+	if len(stale) > 0 {
+		for _, reason := range stale {
+			log.Error("Stale plan: " + reason)
+		}
+		return fmt.Errorf("Consul has changed since the plan was created (%d stale item(s)). Create a new plan.", len(stale))
+	}
+	return nil
+}
+
+// Save writes the plan to a file to be applied later
+func (changes *plan) Save(path string) error {
+	data, err := json.MarshalIndent(changes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// LoadPlan reads a plan saved with Save
+func LoadPlan(path string) (*plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	changes := plan{}
+	if err := json.Unmarshal(data, &changes); err != nil {
+		return nil, fmt.Errorf("Can't load plan file '%s'. %v", path, err)
+	}
+	if changes.FormatVersion == 0 {
+		return nil, fmt.Errorf("File '%s' is not a config2consul plan", path)
+	}
+	if changes.FormatVersion > planFormatVersion {
+		return nil, fmt.Errorf("Plan file '%s' has unsupported format version %d", path, changes.FormatVersion)
+	}
+	return &changes, nil
+}
+
+// IsPlanFile reports if the path points to a plan saved with Save
+func IsPlanFile(path string) bool {
+	fileInfo, err := os.Stat(path)
+	if err != nil || fileInfo.IsDir() {
+		return false
+	}
+	_, err = LoadPlan(path)
+	return err == nil
+}
+
+// checkDeleteLimits refuses plans that delete more items than allowed by the
+// max_deletes and max_delete_percent settings, unless mass deletes were
+// explicitly allowed.
+func (changes *plan) checkDeleteLimits() error {
+	if config.Conf.AllowMassDelete {
+		return nil
+	}
+
+	deletedKeys := []string{}
+	for _, change := range changes.KeyValues {
+		if change.Action == actionDelete {
+			deletedKeys = append(deletedKeys, change.Key)
+		}
+	}
+	deletedAcls := []string{}
+	for _, change := range changes.Policies {
+		if change.Action == actionDelete {
+			deletedAcls = append(deletedAcls, fmt.Sprintf("%s [%s]", change.Name, change.OldType))
+		}
+	}
+	for _, change := range changes.ACLObjects {
+		if change.Action == actionDelete {
+			deletedAcls = append(deletedAcls, fmt.Sprintf("%s %s (ID: %s)", change.Kind, change.Name, change.ID))
+		}
+	}
+	deletedServices := []string{}
+	for _, change := range changes.Services {
+		if change.Action == actionDelete {
+			deletedServices = append(deletedServices, serviceLabel(change.Node, change.ID))
+		}
+	}
+
+	exceeded := false
+	if reason := exceedsDeleteLimits(len(deletedKeys), changes.ManagedKeys); reason != "" {
+		log.Errorf("Refusing to delete %d of %d keys: %s", len(deletedKeys), changes.ManagedKeys, reason)
+		for _, key := range deletedKeys {
+			log.Error("Would delete key: " + key)
+		}
+		exceeded = true
+	}
+	if reason := exceedsDeleteLimits(len(deletedAcls), changes.ManagedAcls); reason != "" {
+		log.Errorf("Refusing to delete %d of %d ACLs: %s", len(deletedAcls), changes.ManagedAcls, reason)
+		for _, name := range deletedAcls {
+			log.Error("Would delete ACL: " + name)
+		}
+		exceeded = true
+	}
+	if reason := exceedsDeleteLimits(len(deletedServices), changes.ManagedServices); reason != "" {
+		log.Errorf("Refusing to deregister %d of %d services: %s", len(deletedServices), changes.ManagedServices, reason)
+		for _, label := range deletedServices {
+			log.Error("Would deregister " + label)
+		}
+		exceeded = true
+	}
+	if exceeded {
+		return errors.New("The plan exceeds the deletion safety limits. Use -allow-mass-delete to apply it anyway.")
+	}
+	return nil
+}
+
+// exceedsDeleteLimits returns the reason why deleting that many items out of
+// the managed ones is not allowed, or an empty string
+func exceedsDeleteLimits(deletes int, managed int) string {
+	if deletes == 0 {
+		return ""
+	}
+	if config.Conf.MaxDeletes > 0 && deletes > config.Conf.MaxDeletes {
+		return fmt.Sprintf("more than max_deletes (%d)", config.Conf.MaxDeletes)
+	}
+	if config.Conf.MaxDeletePercent > 0 && managed > 0 {
+		percent := float64(deletes) * 100 / float64(managed)
+		if percent > config.Conf.MaxDeletePercent {
+			return fmt.Sprintf("%.1f%% is more than max_delete_percent (%g%%)", percent, config.Conf.MaxDeletePercent)
+		}
+	}
+	return ""
+}
+
+// HasChanges reports if applying the plan would write anything to Consul
+func (changes *plan) HasChanges() bool {
+	create, update, remove, _ := changes.count()
+	return create+update+remove > 0
+}
+
+func (changes *plan) count() (create int, update int, remove int, ignore int) {
+	actions := []string{}
+	for _, change := range changes.Policies {
+		actions = append(actions, change.Action)
+	}
+	for _, change := range changes.ACLObjects {
+		actions = append(actions, change.Action)
+	}
+	for _, change := range changes.KeyValues {
+		actions = append(actions, change.Action)
+	}
+	for _, change := range changes.Services {
+		actions = append(actions, change.Action)
+	}
+	for _, action := range actions {
+		switch action {
+		case actionCreate:
+			create++
+		case actionUpdate:
+			update++
+		case actionDelete:
+			remove++
+		case actionIgnore:
+			ignore++
+		}
+	}
+	return
+}
+
+// Print writes a human-readable diff of the plan
+func (changes *plan) Print(w io.Writer) {
+	if len(changes.Policies) > 0 {
+		fmt.Fprintln(w, "ACL changes:")
+		for _, change := range changes.Policies {
+			printAclChange(w, &change)
+		}
+		fmt.Fprintln(w)
+	}
+	if len(changes.ACLObjects) > 0 {
+		fmt.Fprintln(w, "ACL policy, role and token changes:")
+		for _, change := range changes.ACLObjects {
+			printAclObjectChange(w, &change)
+		}
+		fmt.Fprintln(w)
+	}
+	if len(changes.KeyValues) > 0 {
+		fmt.Fprintln(w, "Key/Value changes:")
+		for _, change := range changes.KeyValues {
+			printKVChange(w, &change)
+		}
+		fmt.Fprintln(w)
+	}
+	if len(changes.Services) > 0 {
+		fmt.Fprintln(w, "Service changes:")
+		for _, change := range changes.Services {
+			printServiceChange(w, &change)
+		}
+		fmt.Fprintln(w)
+	}
+
+	create, update, remove, ignore := changes.count()
+	if create+update+remove == 0 {
+		fmt.Fprintf(w, "No changes. Consul matches the rules (%d ignored).\n", ignore)
+		return
+	}
+	fmt.Fprintf(w, "Plan: %d to create, %d to update, %d to delete, %d ignored.\n", create, update, remove, ignore)
+}
+
+func printKVChange(w io.Writer, change *kvChange) {
+	switch change.Action {
+	case actionCreate:
+		fmt.Fprintf(w, "  + %s = %s%s\n", change.Key, displayValue(change.Value), displayFlags(0, change.Flags))
+	case actionUpdate:
+		fmt.Fprintf(w, "  ~ %s = %s => %s%s\n", change.Key, displayValue(change.OldValue), displayValue(change.Value), displayFlags(change.OldFlags, change.Flags))
+	case actionDelete:
+		fmt.Fprintf(w, "  - %s (was %s)\n", change.Key, displayValue(change.OldValue))
+	case actionIgnore:
+		fmt.Fprintf(w, "  # %s (%s)\n", change.Key, ignoredNote(change.Reason))
+	}
+}
+
+// ignoredNote explains an ignored item in the plan
+func ignoredNote(reason string) string {
+	if reason == "" {
+		return "ignored"
+	}
+	return "ignored, " + reason
+}
+
+// displayFlags formats changed flags for the plan
+func displayFlags(old uint64, flags uint64) string {
+	switch {
+	case old == flags:
+		return ""
+	case old == 0:
+		return fmt.Sprintf(" (flags %d)", flags)
+	default:
+		return fmt.Sprintf(" (flags %d => %d)", old, flags)
+	}
+}
+
+func printAclChange(w io.Writer, change *aclChange) {
+	switch change.Action {
+	case actionCreate:
+		fmt.Fprintf(w, "  + %s [%s]\n", change.Name, change.Type)
+		printRules(w, "      + ", change.Rules)
+	case actionUpdate:
+		fmt.Fprintf(w, "  ~ %s [%s]\n", change.Name, change.Type)
+		if change.OldType != change.Type {
+			fmt.Fprintf(w, "      type: %s => %s\n", change.OldType, change.Type)
+		}
+		if change.OldRules != change.Rules {
+			printRules(w, "      - ", change.OldRules)
+			printRules(w, "      + ", change.Rules)
+		}
+	case actionDelete:
+		fmt.Fprintf(w, "  - %s [%s]\n", change.Name, change.OldType)
+	case actionIgnore:
+		fmt.Fprintf(w, "  # %s (%s)\n", change.Name, ignoredNote(change.Reason))
+	}
+}
+
+func printAclObjectChange(w io.Writer, change *aclObjectChange) {
+	switch change.Action {
+	case actionCreate:
+		fmt.Fprintf(w, "  + %s %q\n", change.Kind, change.Name)
+		printLines(w, "      + ", change.describe())
+	case actionUpdate:
+		fmt.Fprintf(w, "  ~ %s %q (ID: %s)\n", change.Kind, change.Name, change.ID)
+		printLineDiff(w, change.Old, change.describe())
+	case actionDelete:
+		fmt.Fprintf(w, "  - %s %q (ID: %s)\n", change.Kind, change.Name, change.ID)
+	case actionIgnore:
+		fmt.Fprintf(w, "  # %s %q (%s)\n", change.Kind, change.Name, ignoredNote(change.Reason))
+	}
+}
+
+func printServiceChange(w io.Writer, change *serviceChange) {
+	switch change.Action {
+	case actionCreate:
+		fmt.Fprintf(w, "  + %q on %s\n", change.ID, change.Node)
+		printLines(w, "      + ", change.Service.describe())
+	case actionUpdate:
+		fmt.Fprintf(w, "  ~ %q on %s\n", change.ID, change.Node)
+		printLineDiff(w, change.Old, change.Service.describe())
+	case actionDelete:
+		fmt.Fprintf(w, "  - %q on %s\n", change.ID, change.Node)
+	}
+}
+
+// printLineDiff prints the lines which are only in old or only in new
+func printLineDiff(w io.Writer, old []string, new []string) {
+	inOld := make(map[string]bool)
+	for _, line := range old {
+		inOld[line] = true
+	}
+	inNew := make(map[string]bool)
+	for _, line := range new {
+		inNew[line] = true
+	}
+	for _, line := range old {
+		if !inNew[line] {
+			fmt.Fprintln(w, "      - "+line)
+		}
+	}
+	for _, line := range new {
+		if !inOld[line] {
+			fmt.Fprintln(w, "      + "+line)
+		}
+	}
+}
+
+func printLines(w io.Writer, prefix string, lines []string) {
+	for _, line := range lines {
+		fmt.Fprintln(w, prefix+line)
+	}
+}
+
+func printRules(w io.Writer, prefix string, rules string) {
+	if rules == "" {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimRight(rules, "\n"), "\n") {
+		fmt.Fprintln(w, prefix+line)
+	}
+}
@@ -0,0 +1,365 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"bytes"
+	"config2consul/config"
+	"config2consul/log"
+	"encoding/json"
+	"fmt"
+	consulapi "github.com/hashicorp/consul/api"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeleteLimits(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	deletePlan := func(keys int, managed int) *plan {
+		changes := plan{ManagedKeys: managed}
+		for i := 0; i < keys; i++ {
+			changes.KeyValues = append(changes.KeyValues, kvChange{Action: actionDelete, Key: fmt.Sprintf("key%d", i)})
+		}
+		return &changes
+	}
+
+	Convey("Deletion safety limits", t, func() {
+		defer func() { config.Conf = config.Config{} }()
+
+		Convey("No limits are enforced by default", func() {
+			So(deletePlan(1000, 1000).checkDeleteLimits(), ShouldBeNil)
+		})
+
+		Convey("The absolute limit is enforced", func() {
+			config.Conf.MaxDeletes = 10
+			So(deletePlan(10, 1000).checkDeleteLimits(), ShouldBeNil)
+			So(deletePlan(11, 1000).checkDeleteLimits(), ShouldNotBeNil)
+		})
+
+		Convey("The percentage limit is enforced", func() {
+			config.Conf.MaxDeletePercent = 50
+			So(deletePlan(5, 10).checkDeleteLimits(), ShouldBeNil)
+			So(deletePlan(6, 10).checkDeleteLimits(), ShouldNotBeNil)
+		})
+
+		Convey("ACL deletes are limited too", func() {
+			config.Conf.MaxDeletes = 1
+			changes := plan{
+				ManagedAcls: 3,
+				Policies: []aclChange{
+					{Action: actionDelete, Name: "a"},
+					{Action: actionDelete, Name: "b"},
+				},
+			}
+			So(changes.checkDeleteLimits(), ShouldNotBeNil)
+		})
+
+		Convey("Limits can be overridden", func() {
+			config.Conf.MaxDeletes = 10
+			config.Conf.AllowMassDelete = true
+			So(deletePlan(1000, 1000).checkDeleteLimits(), ShouldBeNil)
+		})
+	})
+}
+
+func TestDriftReport(t *testing.T) {
+	Convey("Reporting drift", t, func() {
+		Convey("A plan without changes has no drift", func() {
+			changes := plan{KeyValues: []kvChange{{Action: actionIgnore, Key: "ignored/"}}}
+			report := changes.DriftReport("localhost:8500")
+			So(report.Drift, ShouldBeFalse)
+			So(report.RunawayKeys, ShouldBeEmpty)
+		})
+
+		Convey("Every change is reported as a deviation", func() {
+			changes := plan{
+				Policies: []aclChange{
+					{Action: actionDelete, Name: "intruder", ID: "intruder-token-secret"},
+					{Action: actionUpdate, Name: "changed", ID: "changed-token-secret"},
+				},
+				ACLObjects: []aclObjectChange{
+					{Action: actionCreate, Kind: aclKindToken, Name: "missing"},
+				},
+				KeyValues: []kvChange{
+					{Action: actionDelete, Key: "runaway", OldValue: "secret"},
+					{Action: actionUpdate, Key: "changed", Value: "new", OldValue: "secret"},
+					{Action: actionCreate, Key: "missing", Value: "new"},
+				},
+			}
+			report := changes.DriftReport("localhost:8500")
+			So(report.Drift, ShouldBeTrue)
+			So(report.UnexpectedAcls, ShouldResemble, []aclDrift{{Kind: "legacy", Name: "intruder"}})
+			So(report.ChangedAcls, ShouldResemble, []aclDrift{{Kind: "legacy", Name: "changed"}})
+			So(report.MissingAcls, ShouldResemble, []aclDrift{{Kind: aclKindToken, Name: "missing"}})
+			So(report.RunawayKeys, ShouldResemble, []string{"runaway"})
+			So(report.ChangedKeys, ShouldResemble, []string{"changed"})
+			So(report.MissingKeys, ShouldResemble, []string{"missing"})
+
+			var out bytes.Buffer
+			So(report.Write(&out), ShouldBeNil)
+			So(out.String(), ShouldNotContainSubstring, "secret")
+		})
+
+		Convey("The IDs of legacy ACLs are never reported as they are token secrets", func() {
+			changes := plan{Policies: []aclChange{
+				{Action: actionDelete, Name: "intruder", ID: "3f1b6c2e-token"},
+				{Action: actionIgnore, Name: "vault", ID: "8a2d9e4f-token", Reason: "protected: vault"},
+			}}
+			changes.Policies = append(changes.Policies, aclChange{Action: actionUpdate, Name: "changed", Type: "client", OldType: "client", ID: "c4e7a1b0-token"})
+			var out bytes.Buffer
+			So(changes.DriftReport("localhost:8500").Write(&out), ShouldBeNil)
+			changes.Print(&out)
+			So(out.String(), ShouldContainSubstring, "intruder")
+			So(out.String(), ShouldContainSubstring, "~ changed [client]")
+			So(out.String(), ShouldNotContainSubstring, "-token")
+		})
+	})
+}
+
+func TestApplyPlan(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	Convey("Applying a plan", t, func() {
+		requests := []string{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.URL.Path)
+			switch r.URL.Path {
+			case "/v1/txn":
+				w.Write([]byte(`{"Results": [], "Errors": null}`))
+			case "/v1/agent/service/register":
+			default:
+				http.Error(w, "failed", http.StatusInternalServerError)
+			}
+		}))
+		defer server.Close()
+		client, err := consulapi.NewClient(&consulapi.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+		So(err, ShouldBeNil)
+		consul := consulClient{Client: client}
+
+		Convey("A failing section doesn't stop the others", func() {
+			changes := plan{
+				Policies:  []aclChange{{Action: actionCreate, Name: "app", Type: "client"}},
+				KeyValues: []kvChange{{Action: actionCreate, Key: "key", Value: "value"}},
+				Services:  []serviceChange{{Action: actionCreate, ID: "web", Name: "web", Service: &service{ID: "web", Name: "web"}}},
+			}
+			err := consul.applyPlan(&changes)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Failed to apply 1 ACL change(s)")
+			So(requests, ShouldContain, "/v1/txn")
+			So(requests, ShouldContain, "/v1/agent/service/register")
+		})
+
+		Convey("The failures of all the sections are reported together", func() {
+			changes := plan{
+				Policies: []aclChange{{Action: actionCreate, Name: "app", Type: "client"}},
+				Services: []serviceChange{{Action: actionUpdate, ID: "web", Name: "web", Node: "node", Service: &service{ID: "web", Name: "web", Node: "node"}}},
+			}
+			err := consul.applyPlan(&changes)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Failed to apply 1 ACL change(s). Failed to apply 1 service change(s)")
+		})
+	})
+}
+
+func TestBinaryValues(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	binary := string([]byte{0xca, 0xfe, 0x00, 0xff})
+
+	Convey("Planning binary values", t, func() {
+		Convey("Binary values survive a saved plan", func() {
+			dir, err := ioutil.TempDir("", "config2consul")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+
+			changes := plan{FormatVersion: planFormatVersion, KeyValues: []kvChange{
+				{Action: actionUpdate, Key: "keystore", Value: binary, OldValue: "text", ModifyIndex: 4},
+				{Action: actionCreate, Key: "name", Value: "app"},
+			}}
+			path := filepath.Join(dir, "plan.json")
+			So(changes.Save(path), ShouldBeNil)
+
+			data, err := ioutil.ReadFile(path)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, `"value": "yv4A/w=="`)
+			So(string(data), ShouldContainSubstring, `"old_value": "dGV4dA=="`)
+
+			loaded, err := LoadPlan(path)
+			So(err, ShouldBeNil)
+			So(loaded.KeyValues, ShouldResemble, changes.KeyValues)
+		})
+
+		Convey("Binary values are printed by size and checksum", func() {
+			var out bytes.Buffer
+			changes := plan{KeyValues: []kvChange{{Action: actionCreate, Key: "keystore", Value: binary}}}
+			changes.Print(&out)
+			So(out.String(), ShouldContainSubstring, "+ keystore = <binary, 4 bytes, sha256 ")
+		})
+
+		Convey("Binary values are compared byte for byte", func() {
+			keyValue := map[string]interface{}{"same": binary, "changed": binary}
+			current := map[string]*consulapi.KVPair{
+				"same":    {Key: "same", Value: []byte{0xca, 0xfe, 0x00, 0xff}},
+				"changed": {Key: "changed", Value: []byte{0xca, 0xfe, 0x00, 0xfe}},
+			}
+			changes := []kvChange{}
+			So(planTree(&keyValue, kvScope{""}, current, &changes), ShouldBeNil)
+			So(changes, ShouldHaveLength, 1)
+			So(changes[0].Key, ShouldEqual, "changed")
+		})
+	})
+}
+
+func TestIgnorePatterns(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	Convey("Ignoring items by pattern", t, func() {
+		rules := ignoreRules{
+			KV:     []string{"app/*/cache", "regex:^tmp/[0-9]+$"},
+			Acls:   []string{"Vault *"},
+			Tokens: []string{"regex:^ci-"},
+		}
+		changes := plan{
+			KeyValues: []kvChange{
+				{Action: actionDelete, Key: "app/web/cache", OldValue: "x"},
+				{Action: actionDelete, Key: "app/web/deep/cache", OldValue: "x"},
+				{Action: actionUpdate, Key: "tmp/42", Value: "a", OldValue: "b"},
+				{Action: actionCreate, Key: "tmp/42/x", Value: "a"},
+			},
+			Policies: []aclChange{
+				{Action: actionDelete, ID: "1", Name: "Vault token-a"},
+				{Action: actionDelete, ID: "2", Name: "Other"},
+			},
+			ACLObjects: []aclObjectChange{
+				{Action: actionDelete, Kind: aclKindToken, ID: "3", Name: "ci-runner"},
+				{Action: actionDelete, Kind: aclKindRole, ID: "4", Name: "ci-role"},
+			},
+		}
+
+		Convey("Matching changes are ignored with the pattern as reason", func() {
+			So(changes.applyIgnore(&rules), ShouldBeNil)
+			So(changes.KeyValues, ShouldResemble, []kvChange{
+				{Action: actionIgnore, Key: "app/web/cache", Reason: `matches ignore pattern "app/*/cache"`},
+				{Action: actionDelete, Key: "app/web/deep/cache", OldValue: "x"},
+				{Action: actionIgnore, Key: "tmp/42", Reason: `matches ignore pattern "regex:^tmp/[0-9]+$"`},
+				{Action: actionCreate, Key: "tmp/42/x", Value: "a"},
+			})
+			So(changes.Policies[0], ShouldResemble, aclChange{Action: actionIgnore, ID: "1", Name: "Vault token-a", Reason: `matches ignore pattern "Vault *"`})
+			So(changes.Policies[1].Action, ShouldEqual, actionDelete)
+			So(changes.ACLObjects[0].Action, ShouldEqual, actionIgnore)
+			So(changes.ACLObjects[1].Action, ShouldEqual, actionDelete)
+
+			var out bytes.Buffer
+			changes.Print(&out)
+			So(out.String(), ShouldContainSubstring, `# app/web/cache (ignored, matches ignore pattern "app/*/cache")`)
+
+			report := changes.DriftReport("localhost")
+			So(report.Ignored, ShouldContain, ignoredDrift{Kind: "kv", Name: "tmp/42", Reason: `matches ignore pattern "regex:^tmp/[0-9]+$"`})
+			So(report.Ignored, ShouldContain, ignoredDrift{Kind: aclKindToken, Name: "ci-runner", Reason: `matches ignore pattern "regex:^ci-"`})
+			So(report.RunawayKeys, ShouldResemble, []string{"app/web/deep/cache"})
+		})
+
+		Convey("Invalid patterns are an error", func() {
+			So(changes.applyIgnore(&ignoreRules{KV: []string{"regex:("}}), ShouldNotBeNil)
+			So(changes.applyIgnore(&ignoreRules{Acls: []string{"[a"}}), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestProtectedAcls(t *testing.T) {
+	Convey("Protecting ACLs", t, func() {
+		defer func() { config.Conf = config.Config{} }()
+		config.Conf.ProtectedAcls = []config.ProtectedAcl{
+			{Prefix: "nomad-", Reason: "Created by Nomad"},
+			{ID: "1234", Reason: "Terraform state"},
+			{Name: "exact"},
+		}
+
+		Convey("ACLs are matched by name, ID and prefix", func() {
+			protected := protectedAcls()
+			So(findProtection(protected, "a", "nomad-server").Reason, ShouldEqual, "Created by Nomad")
+			So(findProtection(protected, "1234", "anything").Reason, ShouldEqual, "Terraform state")
+			So(protectionReason(findProtection(protected, "b", "exact")), ShouldEqual, "protected")
+			So(findProtection(protected, "c", "exact-not"), ShouldBeNil)
+		})
+
+		Convey("The master token is always protected", func() {
+			So(protectionReason(findProtection(protectedAcls(), "d", "Master Token")), ShouldEqual, "protected: The master token is never deleted")
+
+			config.Conf.ProtectedAcls = nil
+			So(findProtection(protectedAcls(), "d", "Master Token"), ShouldNotBeNil)
+
+			config.Conf.ProtectedAcls = []config.ProtectedAcl{}
+			So(findProtection(protectedAcls(), "d", "Master Token"), ShouldNotBeNil)
+		})
+
+		Convey("The deprecated settings still protect their ACLs", func() {
+			So(findProtection(protectedAcls(), "e", "Vault abc"), ShouldBeNil)
+			So(findProtection(protectedAcls(), "f", "Anonymous Token"), ShouldBeNil)
+
+			config.Conf.PreserveVaultACLs = true
+			config.Conf.PreserveBuiltInTokens = true
+			So(protectionReason(findProtection(protectedAcls(), "e", "Vault abc")), ShouldEqual, "protected: preserve_vault_acls is set")
+			So(findProtection(protectedAcls(), "f", "Anonymous Token"), ShouldNotBeNil)
+		})
+
+		Convey("The deprecated settings are read from the config file", func() {
+			var conf config.Config
+			So(json.Unmarshal([]byte(`{"preserve_vault_acls": true, "preserve_builtin_tokens": true}`), &conf), ShouldBeNil)
+			So(conf.PreserveVaultACLs, ShouldBeTrue)
+			So(conf.PreserveBuiltInTokens, ShouldBeTrue)
+		})
+	})
+}
+
+func TestManagedScope(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	Convey("Planning keys against the managed prefixes", t, func() {
+		scope := kvScope{"team-a/"}
+		planKeys := func(keyValue map[string]interface{}) ([]kvChange, error) {
+			changes := []kvChange{}
+			err := planTree(&keyValue, scope, map[string]*consulapi.KVPair{}, &changes)
+			return changes, err
+		}
+
+		Convey("A key outside of the managed prefixes is rejected", func() {
+			_, err := planKeys(map[string]interface{}{"team-b/key": "value"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Ignored keys and trees outside of the managed prefixes are skipped", func() {
+			changes, err := planKeys(map[string]interface{}{
+				"team-b/key": "${ignore}",
+				"team-c/":    map[interface{}]interface{}{"cache": "${ignore}"},
+				"team-d/":    "${ignore}",
+			})
+			So(err, ShouldBeNil)
+			So(len(changes), ShouldEqual, 3)
+			for _, change := range changes {
+				So(change.Action, ShouldEqual, actionIgnore)
+			}
+		})
+	})
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2consul/config"
+	"strings"
+)
+
+// masterToken is protected whatever the config file says, as deleting it
+// locks everyone out of the cluster
+var masterToken = config.ProtectedAcl{Name: "Master Token", Reason: "The master token is never deleted"}
+
+// protectedAcls returns the master token, the protected_acls of the config
+// file, and the ACLs protected by the deprecated preserve_builtin_tokens and
+// preserve_vault_acls settings
+func protectedAcls() []config.ProtectedAcl {
+	protected := append([]config.ProtectedAcl{masterToken}, config.Conf.ProtectedAcls...)
+	if config.Conf.PreserveBuiltInTokens {
+		protected = append(protected, config.ProtectedAcl{Name: "Anonymous Token", Reason: "preserve_builtin_tokens is set"})
+	}
+	if config.Conf.PreserveVaultACLs {
+		protected = append(protected, config.ProtectedAcl{Prefix: "Vault ", Reason: "preserve_vault_acls is set"})
+	}
+	return protected
+}
+
+// findProtection returns the first protection matching the ACL, or nil
+func findProtection(protected []config.ProtectedAcl, id string, name string) *config.ProtectedAcl {
+	for i := range protected {
+		entry := &protected[i]
+		switch {
+		case entry.Name != "" && entry.Name == name,
+			entry.ID != "" && entry.ID == id,
+			entry.Prefix != "" && strings.HasPrefix(name, entry.Prefix):
+			return entry
+		}
+	}
+	return nil
+}
+
+// protectionReason explains an ignored ACL in the plan
+func protectionReason(protection *config.ProtectedAcl) string {
+	if protection.Reason == "" {
+		return "protected"
+	}
+	return "protected: " + protection.Reason
+}
@@ -0,0 +1,489 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+// Convergence of the service catalog. Only the services registered by
+// config2consul carry the managedByMeta marker, so the services registered
+// dynamically by agents are never updated or deleted.
+
+import (
+	"config2consul/log"
+	"errors"
+	"fmt"
+	consulapi "github.com/hashicorp/consul/api"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The meta key and value which mark a service as registered by config2consul
+const (
+	managedByMeta  = "managed-by"
+	managedByValue = "config2consul"
+)
+
+// serviceCheck is an HTTP or TCP health check of a service
+type serviceCheck struct {
+	Name     string `yaml:"name" json:"name"`
+	HTTP     string `yaml:"http,omitempty" json:"http,omitempty"`
+	TCP      string `yaml:"tcp,omitempty" json:"tcp,omitempty"`
+	Interval string `yaml:"interval,omitempty" json:"interval,omitempty"`
+	Timeout  string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// service is a catalog registration of an external service if Node is
+// declared, or a registration with the agent config2consul talks to
+// otherwise. The ID defaults to the name, NodeAddress to the address.
+type service struct {
+	ID          string            `yaml:"id,omitempty" json:"id,omitempty"`
+	Name        string            `yaml:"name" json:"name"`
+	Node        string            `yaml:"node,omitempty" json:"node,omitempty"`
+	NodeAddress string            `yaml:"node_address,omitempty" json:"node_address,omitempty"`
+	Address     string            `yaml:"address,omitempty" json:"address,omitempty"`
+	Port        int               `yaml:"port,omitempty" json:"port,omitempty"`
+	Tags        []string          `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Meta        map[string]string `yaml:"meta,omitempty" json:"meta,omitempty"`
+	Checks      []serviceCheck    `yaml:"checks,omitempty" json:"checks,omitempty"`
+}
+
+// serviceChange is a change of a registered service. Node is the node the
+// service is registered on, Old holds the description of the existing
+// registration for the review of the plan.
+type serviceChange struct {
+	Action      string   `json:"action"`
+	Node        string   `json:"node"`
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Service     *service `json:"service,omitempty"`
+	Old         []string `json:"old,omitempty"`
+	ModifyIndex uint64   `json:"modify_index,omitempty"`
+}
+
+// registeredService is a managed service found in the catalog
+type registeredService struct {
+	service     service
+	modifyIndex uint64
+}
+
+func serviceLabel(node string, id string) string {
+	if node == "" {
+		return fmt.Sprintf("service '%s'", id)
+	}
+	return fmt.Sprintf("service '%s' on node '%s'", id, node)
+}
+
+func (s *service) serviceID() string {
+	if s.ID != "" {
+		return s.ID
+	}
+	return s.Name
+}
+
+func (s *service) nodeAddress() string {
+	if s.NodeAddress != "" {
+		return s.NodeAddress
+	}
+	return s.Address
+}
+
+// describe lists the settings of the service in a stable order, to compare
+// and review registrations. The marker is left out.
+func (s *service) describe() []string {
+	lines := []string{"name: " + s.Name}
+	if s.Node != "" {
+		lines = append(lines, "node address: "+s.nodeAddress())
+	}
+	if s.Address != "" {
+		lines = append(lines, "address: "+s.Address)
+	}
+	if s.Port != 0 {
+		lines = append(lines, fmt.Sprintf("port: %d", s.Port))
+	}
+	for _, tag := range sortedStrings(s.Tags) {
+		lines = append(lines, "tag: "+tag)
+	}
+	meta := []string{}
+	for key, value := range s.Meta {
+		if key != managedByMeta {
+			meta = append(meta, fmt.Sprintf("meta: %s = %s", key, value))
+		}
+	}
+	sort.Strings(meta)
+	lines = append(lines, meta...)
+
+	checks := []string{}
+	for _, check := range s.Checks {
+		line := "check: " + check.Name
+		if check.HTTP != "" {
+			line += ", http " + check.HTTP
+		}
+		if check.TCP != "" {
+			line += ", tcp " + check.TCP
+		}
+		if check.Interval != "" {
+			line += ", interval " + normalizeDuration(check.Interval)
+		}
+		if check.Timeout != "" {
+			line += ", timeout " + normalizeDuration(check.Timeout)
+		}
+		checks = append(checks, line)
+	}
+	sort.Strings(checks)
+	return append(lines, checks...)
+}
+
+// normalizeDuration formats a duration the way Consul returns it
+func normalizeDuration(value string) string {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return value
+	}
+	return duration.String()
+}
+
+// validate checks the parts of the service Consul can't register
+func (s *service) validate() error {
+	label := serviceLabel(s.Node, s.serviceID())
+	if s.Name == "" {
+		return errors.New("A service without a name")
+	}
+	if s.Node != "" && s.nodeAddress() == "" {
+		return fmt.Errorf("The %s needs a node_address or an address", label)
+	}
+	for _, check := range s.Checks {
+		if check.Name == "" {
+			return fmt.Errorf("A check of the %s has no name", label)
+		}
+		if (check.HTTP == "") == (check.TCP == "") {
+			return fmt.Errorf("Check '%s' of the %s must have either http or tcp", check.Name, label)
+		}
+		for _, value := range []string{check.Interval, check.Timeout} {
+			if _, err := time.ParseDuration(value); value != "" && err != nil {
+				return fmt.Errorf("Check '%s' of the %s has an invalid duration. %v", check.Name, label, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkID identifies a check of a service
+func (s *service) checkID(check *serviceCheck) string {
+	return fmt.Sprintf("service:%s:%s", s.serviceID(), check.Name)
+}
+
+// meta returns the meta of the service with the marker
+func (s *service) meta() map[string]string {
+	meta := make(map[string]string)
+	for key, value := range s.Meta {
+		meta[key] = value
+	}
+	meta[managedByMeta] = managedByValue
+	return meta
+}
+
+func (s *service) agentRegistration() *consulapi.AgentServiceRegistration {
+	registration := &consulapi.AgentServiceRegistration{
+		ID:      s.serviceID(),
+		Name:    s.Name,
+		Address: s.Address,
+		Port:    s.Port,
+		Tags:    s.Tags,
+		Meta:    s.meta(),
+	}
+	for i := range s.Checks {
+		check := s.Checks[i]
+		registration.Checks = append(registration.Checks, &consulapi.AgentServiceCheck{
+			CheckID:  s.checkID(&check),
+			Name:     check.Name,
+			HTTP:     check.HTTP,
+			TCP:      check.TCP,
+			Interval: check.Interval,
+			Timeout:  check.Timeout,
+		})
+	}
+	return registration
+}
+
+func (s *service) catalogRegistration() *consulapi.CatalogRegistration {
+	registration := &consulapi.CatalogRegistration{
+		Node:    s.Node,
+		Address: s.nodeAddress(),
+		Service: &consulapi.AgentService{
+			ID:      s.serviceID(),
+			Service: s.Name,
+			Address: s.Address,
+			Port:    s.Port,
+			Tags:    s.Tags,
+			Meta:    s.meta(),
+		},
+	}
+	for i := range s.Checks {
+		check := s.Checks[i]
+		interval, _ := time.ParseDuration(check.Interval)
+		timeout, _ := time.ParseDuration(check.Timeout)
+		registration.Checks = append(registration.Checks, &consulapi.HealthCheck{
+			Node:      s.Node,
+			CheckID:   s.checkID(&check),
+			Name:      check.Name,
+			ServiceID: s.serviceID(),
+			Definition: consulapi.HealthCheckDefinition{
+				HTTP:             check.HTTP,
+				TCP:              check.TCP,
+				IntervalDuration: interval,
+				TimeoutDuration:  timeout,
+			},
+		})
+	}
+	return registration
+}
+
+// serviceFromCatalog converts a registration and its checks to the rules
+func serviceFromCatalog(entry *consulapi.CatalogService, checks consulapi.HealthChecks) service {
+	registered := service{
+		ID:          entry.ServiceID,
+		Name:        entry.ServiceName,
+		Node:        entry.Node,
+		NodeAddress: entry.Address,
+		Address:     entry.ServiceAddress,
+		Port:        entry.ServicePort,
+		Tags:        entry.ServiceTags,
+		Meta:        entry.ServiceMeta,
+	}
+	for _, check := range checks {
+		if check.Node != entry.Node || check.ServiceID != entry.ServiceID {
+			continue
+		}
+		converted := serviceCheck{Name: check.Name, HTTP: check.Definition.HTTP, TCP: check.Definition.TCP}
+		if check.Definition.IntervalDuration != 0 {
+			converted.Interval = check.Definition.IntervalDuration.String()
+		}
+		if check.Definition.TimeoutDuration != 0 {
+			converted.Timeout = check.Definition.TimeoutDuration.String()
+		}
+		registered.Checks = append(registered.Checks, converted)
+	}
+	return registered
+}
+
+// getManagedServices lists the services registered by config2consul by their
+// node and ID
+func (consul *consulClient) getManagedServices() (map[string]*registeredService, error) {
+	q := consulapi.QueryOptions{}
+	names, _, err := consul.Client.Catalog().Services(&q)
+	if err != nil {
+		log.Errorf("Failed to list services. %v", err)
+		return nil, err
+	}
+
+	managed := make(map[string]*registeredService)
+	for name := range names {
+		entries, _, err := consul.Client.Catalog().Service(name, "", &q)
+		if err != nil {
+			log.Errorf("Failed to read service '%s'. %v", name, err)
+			return nil, err
+		}
+		var checks consulapi.HealthChecks
+		for _, entry := range entries {
+			if entry.ServiceMeta[managedByMeta] != managedByValue {
+				continue
+			}
+			if checks == nil {
+				if checks, _, err = consul.Client.Health().Checks(name, &q); err != nil {
+					log.Errorf("Failed to read the checks of service '%s'. %v", name, err)
+					return nil, err
+				}
+			}
+			managed[serviceLabel(entry.Node, entry.ServiceID)] = &registeredService{
+				service:     serviceFromCatalog(entry, checks),
+				modifyIndex: entry.ModifyIndex,
+			}
+		}
+	}
+	return managed, nil
+}
+
+// planServices plans the registrations of the services. Services registered
+// with the agent are compared with the registrations on the node of the agent.
+func (consul *consulClient) planServices(newServices []service, changes *plan) error {
+	current, err := consul.getManagedServices()
+	if err != nil {
+		return err
+	}
+	changes.ManagedServices = len(current)
+
+	agentNode := ""
+	declared := make(map[string]bool)
+	upserts := []serviceChange{}
+	for i := range newServices {
+		declaredService := newServices[i]
+		if err := declaredService.validate(); err != nil {
+			log.Error(err.Error())
+			return err
+		}
+
+		node := declaredService.Node
+		if node == "" {
+			if agentNode == "" {
+				if agentNode, err = consul.Client.Agent().NodeName(); err != nil {
+					log.Errorf("Failed to read the node name of the agent. %v", err)
+					return err
+				}
+			}
+			node = agentNode
+		}
+		label := serviceLabel(node, declaredService.serviceID())
+		if declared[label] {
+			return fmt.Errorf("Found duplicate %s in the injest.", label)
+		}
+		declared[label] = true
+
+		existing, ok := current[label]
+		if !ok {
+			log.Infof("The %s will be registered", label)
+			upserts = append(upserts, serviceChange{Action: actionCreate, Node: node, ID: declaredService.serviceID(), Name: declaredService.Name, Service: &declaredService})
+			continue
+		}
+		// Agent registrations are compared without the node address
+		existing.service.Node = declaredService.Node
+		if sameLines(declaredService.describe(), existing.service.describe()) {
+			log.Infof("Skipping %s. Nothing to update.", label)
+			continue
+		}
+		log.Warningf("The %s has been changed", label)
+		upserts = append(upserts, serviceChange{
+			Action:      actionUpdate,
+			Node:        node,
+			ID:          declaredService.serviceID(),
+			Name:        declaredService.Name,
+			Service:     &declaredService,
+			Old:         existing.service.describe(),
+			ModifyIndex: existing.modifyIndex,
+		})
+	}
+
+	labels := make([]string, 0, len(current))
+	for label := range current {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	deletes := []serviceChange{}
+	for _, label := range labels {
+		if declared[label] {
+			continue
+		}
+		existing := current[label]
+		log.Warningf("Found unexpected %s", label)
+		deletes = append(deletes, serviceChange{
+			Action:      actionDelete,
+			Node:        existing.service.Node,
+			ID:          existing.service.ID,
+			Name:        existing.service.Name,
+			ModifyIndex: existing.modifyIndex,
+		})
+	}
+	changes.Services = append(upserts, deletes...)
+	return nil
+}
+
+func sameLines(a []string, b []string) bool {
+	return strings.Join(a, "\n") == strings.Join(b, "\n")
+}
+
+// applyServiceChange registers or deregisters a service. A service without a
+// node is registered with the agent, the checks removed from a catalog
+// registration are deregistered.
+func (consul *consulClient) applyServiceChange(change *serviceChange) error {
+	w := consulapi.WriteOptions{}
+	label := serviceLabel(change.Node, change.ID)
+	var err error
+
+	switch {
+	case change.Action == actionIgnore:
+		return nil
+	case change.Action == actionDelete:
+		log.Warningf("Deregistering unexpected %s", label)
+		agentNode, _ := consul.Client.Agent().NodeName()
+		if change.Node == agentNode {
+			err = consul.Client.Agent().ServiceDeregister(change.ID)
+		} else {
+			_, err = consul.Client.Catalog().Deregister(&consulapi.CatalogDeregistration{Node: change.Node, ServiceID: change.ID}, &w)
+		}
+	case change.Service.Node == "":
+		err = consul.Client.Agent().ServiceRegisterOpts(change.Service.agentRegistration(), consulapi.ServiceRegisterOpts{ReplaceExistingChecks: true})
+	default:
+		if _, err = consul.Client.Catalog().Register(change.Service.catalogRegistration(), &w); err == nil && change.Action == actionUpdate {
+			err = consul.deregisterRemovedChecks(change.Service)
+		}
+	}
+
+	if err != nil {
+		log.Errorf("Failed to %s the %s. %v", change.Action, label, err)
+		return err
+	}
+	if change.Action != actionDelete {
+		log.Infof("The %s has been %sd", label, change.Action)
+	}
+	return nil
+}
+
+// deregisterRemovedChecks removes the checks of a catalog registration which
+// are not declared anymore
+func (consul *consulClient) deregisterRemovedChecks(s *service) error {
+	q := consulapi.QueryOptions{}
+	checks, _, err := consul.Client.Health().Checks(s.Name, &q)
+	if err != nil {
+		return err
+	}
+	declared := make(map[string]bool)
+	for i := range s.Checks {
+		declared[s.checkID(&s.Checks[i])] = true
+	}
+	w := consulapi.WriteOptions{}
+	for _, check := range checks {
+		if check.Node != s.Node || check.ServiceID != s.serviceID() || declared[check.CheckID] {
+			continue
+		}
+		log.Infof("Deregistering check '%s' of the %s", check.Name, serviceLabel(s.Node, s.serviceID()))
+		if _, err := consul.Client.Catalog().Deregister(&consulapi.CatalogDeregistration{Node: s.Node, CheckID: check.CheckID}, &w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyServices returns the reasons why the changes are stale
+func (consul *consulClient) verifyServices(changes []serviceChange) ([]string, error) {
+	current, err := consul.getManagedServices()
+	if err != nil {
+		return nil, err
+	}
+	stale := []string{}
+	for _, change := range changes {
+		label := serviceLabel(change.Node, change.ID)
+		existing, ok := current[label]
+		switch {
+		case change.Action == actionIgnore:
+		case change.Action == actionCreate && ok:
+			stale = append(stale, fmt.Sprintf("The %s was registered", label))
+		case change.Action != actionCreate && !ok:
+			stale = append(stale, fmt.Sprintf("The %s was deregistered", label))
+		case ok && existing.modifyIndex != change.ModifyIndex:
+			stale = append(stale, fmt.Sprintf("The %s was modified (index %d => %d)", label, change.ModifyIndex, existing.modifyIndex))
+		}
+	}
+	return stale, nil
+}
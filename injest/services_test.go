@@ -0,0 +1,123 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"bytes"
+	"config2consul/log"
+	consulapi "github.com/hashicorp/consul/api"
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServices(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	declared := service{
+		Name:    "db",
+		Node:    "external-db",
+		Address: "10.0.0.5",
+		Port:    5432,
+		Tags:    []string{"primary", "eu"},
+		Meta:    map[string]string{"version": "13"},
+		Checks:  []serviceCheck{{Name: "tcp", TCP: "10.0.0.5:5432", Interval: "1m"}},
+	}
+
+	Convey("Managing services", t, func() {
+		Convey("Registrations carry the marker", func() {
+			registration := declared.catalogRegistration()
+			So(registration.Node, ShouldEqual, "external-db")
+			So(registration.Address, ShouldEqual, "10.0.0.5")
+			So(registration.Service.ID, ShouldEqual, "db")
+			So(registration.Service.Meta, ShouldResemble, map[string]string{"version": "13", managedByMeta: managedByValue})
+			So(registration.Checks[0].Definition.IntervalDuration, ShouldEqual, time.Minute)
+
+			agent := service{Name: "api", Meta: map[string]string{managedByMeta: "someone"}}
+			So(agent.agentRegistration().Meta[managedByMeta], ShouldEqual, managedByValue)
+		})
+
+		Convey("A registration read back from the catalog has no changes", func() {
+			entry := &consulapi.CatalogService{
+				Node:           "external-db",
+				Address:        "10.0.0.5",
+				ServiceID:      "db",
+				ServiceName:    "db",
+				ServiceAddress: "10.0.0.5",
+				ServicePort:    5432,
+				ServiceTags:    []string{"eu", "primary"},
+				ServiceMeta:    map[string]string{"version": "13", managedByMeta: managedByValue},
+			}
+			checks := consulapi.HealthChecks{
+				{Node: "external-db", ServiceID: "db", Name: "tcp", Definition: consulapi.HealthCheckDefinition{TCP: "10.0.0.5:5432", IntervalDuration: time.Minute}},
+				{Node: "other", ServiceID: "db", Name: "tcp"},
+			}
+			registered := serviceFromCatalog(entry, checks)
+			So(sameLines(declared.describe(), registered.describe()), ShouldBeTrue)
+
+			entry.ServicePort = 5433
+			changed := serviceFromCatalog(entry, checks)
+			So(sameLines(declared.describe(), changed.describe()), ShouldBeFalse)
+		})
+
+		Convey("Invalid services are rejected", func() {
+			So((&service{}).validate(), ShouldNotBeNil)
+			So((&service{Name: "db", Node: "external"}).validate(), ShouldNotBeNil)
+			So((&service{Name: "db", Checks: []serviceCheck{{Name: "both", HTTP: "http://x", TCP: "x:1"}}}).validate(), ShouldNotBeNil)
+			So((&service{Name: "db", Checks: []serviceCheck{{Name: "tcp", TCP: "x:1", Interval: "often"}}}).validate(), ShouldNotBeNil)
+			So(declared.validate(), ShouldBeNil)
+		})
+
+		Convey("Service changes are planned, printed and reported", func() {
+			changes := plan{Services: []serviceChange{
+				{Action: actionCreate, Node: "external-db", ID: "db", Name: "db", Service: &declared},
+				{Action: actionDelete, Node: "node-1", ID: "old", Name: "old"},
+			}}
+			So(changes.HasChanges(), ShouldBeTrue)
+
+			var out bytes.Buffer
+			changes.Print(&out)
+			So(out.String(), ShouldContainSubstring, `+ "db" on external-db`)
+			So(out.String(), ShouldContainSubstring, "+ check: tcp, tcp 10.0.0.5:5432, interval 1m0s")
+			So(out.String(), ShouldContainSubstring, `- "old" on node-1`)
+
+			report := changes.DriftReport("localhost")
+			So(report.MissingServices, ShouldResemble, []string{"service 'db' on node 'external-db'"})
+			So(report.UnexpectedServices, ShouldResemble, []string{"service 'old' on node 'node-1'"})
+		})
+
+		Convey("Services are loaded and merged like ACLs", func() {
+			dir := writeRules(map[string]string{
+				"a.yml": "services:\n  - name: db\n    node: external-db\n    address: 10.0.0.5\n",
+				"b.yml": "services:\n  - name: db\n    node: external-db\n    address: 10.0.0.6\n",
+				"c.yml": "services:\n  - name: db\n    node: other-db\n    address: 10.0.0.7\n",
+			})
+			defer os.RemoveAll(dir)
+
+			rules := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+			So(loadFile(filepath.Join(dir, "a.yml"), &rules), ShouldBeNil)
+			So(loadFile(filepath.Join(dir, "c.yml"), &rules), ShouldBeNil)
+			So(rules.Services, ShouldHaveLength, 2)
+
+			err := loadFile(filepath.Join(dir, "b.yml"), &rules)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "service 'db' on node 'external-db' is defined in both")
+		})
+	})
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2consul/log"
+	"fmt"
+	yaml3 "gopkg.in/yaml.v3"
+	"strings"
+)
+
+// ruleSource is the file and line a key or ACL is defined at
+type ruleSource struct {
+	file string
+	line int
+}
+
+func (source ruleSource) String() string {
+	if source.line == 0 {
+		return source.file
+	}
+	return fmt.Sprintf("%s:%d", source.file, source.line)
+}
+
+// ruleSources maps the label of every key and ACL to its definition
+type ruleSources map[string]ruleSource
+
+func kvLabel(key string) string         { return fmt.Sprintf("key '%s'", key) }
+func aclLabel(name string) string       { return fmt.Sprintf("ACL '%s'", name) }
+func aclPolicyLabel(name string) string { return fmt.Sprintf("ACL policy '%s'", name) }
+func aclRoleLabel(name string) string   { return fmt.Sprintf("ACL role '%s'", name) }
+
+// aclTokenLabel identifies a token by its accessor ID, or by its description
+// if the accessor ID is generated by Consul
+func aclTokenLabel(accessorID string, description string) string {
+	if accessorID != "" {
+		return fmt.Sprintf("ACL token '%s'", accessorID)
+	}
+	return fmt.Sprintf("ACL token '%s'", description)
+}
+
+// locateDefinitions finds the lines of every key and ACL of a rule file. The rules themselves are decoded with yaml.v2 to keep the YAML 1.1
+// values, only the positions come from yaml.v3. Fails if the file defines
+// an ACL twice. The lines are left out for files converted to YAML.
+func locateDefinitions(filename string, data []byte, withLines bool) (ruleSources, error) {
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	sources := ruleSources{}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml3.MappingNode {
+		return sources, nil
+	}
+
+	add := func(label string, line int) error {
+		if !withLines {
+			line = 0
+		}
+		if previous, ok := sources[label]; ok {
+			return fmt.Errorf("%s is defined twice: %s and %s", label, previous, ruleSource{file: filename, line: line})
+		}
+		sources[label] = ruleSource{file: filename, line: line}
+		return nil
+	}
+
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		section, value := root.Content[i].Value, root.Content[i+1]
+		for j, entry := range value.Content {
+			var err error
+			switch section {
+			case "kv":
+				if j == 0 {
+					err = locateKeys(value, "", add)
+				}
+			case "policies":
+				err = add(aclLabel(nodeField(entry, "name")), entry.Line)
+			case "acl_policies":
+				err = add(aclPolicyLabel(nodeField(entry, "name")), entry.Line)
+			case "acl_roles":
+				err = add(aclRoleLabel(nodeField(entry, "name")), entry.Line)
+			case "acl_tokens":
+				err = add(aclTokenLabel(nodeField(entry, "accessor_id"), nodeField(entry, "description")), entry.Line)
+			case "services":
+				declared := service{ID: nodeField(entry, "id"), Name: nodeField(entry, "name")}
+				err = add(serviceLabel(nodeField(entry, "node"), declared.serviceID()), entry.Line)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return sources, nil
+}
+
+// locateKeys adds the full path of every key of a KV tree, the way flattenKV
+// names them. Top level trees end with a '/', nested trees don't.
+func locateKeys(tree *yaml3.Node, path string, add func(label string, line int) error) error {
+	for i := 0; i+1 < len(tree.Content); i += 2 {
+		keyNode, value := tree.Content[i], tree.Content[i+1]
+		key := path + keyNode.Value
+		if value.Kind == yaml3.MappingNode && valueMapping(value) == "" {
+			if path != "" {
+				key += "/"
+			}
+			if strings.HasSuffix(key, "/") {
+				if err := locateKeys(value, key, add); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := add(kvLabel(key), keyNode.Line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nodeField returns the scalar value of a field of a mapping node
+func nodeField(node *yaml3.Node, name string) string {
+	if node.Kind != yaml3.MappingNode {
+		return ""
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == name {
+			return node.Content[i+1].Value
+		}
+	}
+	return ""
+}
+
+// claim records the definition of a key or ACL by a rule file. Returns an
+// error naming both files if the file redefines it without setting override.
+func (masterConfig *consulConfig) claim(label string, override bool, sources ruleSources, filename string) error {
+	if masterConfig.sources == nil {
+		masterConfig.sources = ruleSources{}
+	}
+	source, ok := sources[label]
+	if !ok {
+		source = ruleSource{file: filename}
+	}
+
+	previous, defined := masterConfig.sources[label]
+	if defined && !override {
+		return fmt.Errorf("%s is defined in both %s and %s. Set 'override: true' in %s to replace it on purpose", label, previous, source, filename)
+	}
+	if defined {
+		log.Infof("%s from %s overrides %s", label, source, previous)
+	}
+	masterConfig.sources[label] = source
+	return nil
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"bytes"
+	"config2consul/config"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// templateSuffix marks the rule files rendered with text/template before
+// they are decoded
+const templateSuffix = ".tmpl"
+
+// templateData is the data a rule template is executed with
+type templateData struct {
+	Vars map[string]string
+}
+
+// renderTemplate executes a rule file as a template. Errors point at the
+// line of the template.
+func renderTemplate(filename string, data []byte) ([]byte, error) {
+	funcs := template.FuncMap{
+		"env": os.Getenv,
+		"file": func(path string) (string, error) {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(filepath.Dir(filename), path)
+			}
+			content, err := ioutil.ReadFile(path)
+			return string(content), err
+		},
+		"base64": func(value string) string {
+			return base64.StdEncoding.EncodeToString([]byte(value))
+		},
+		"toJson": func(value interface{}) (string, error) {
+			encoded, err := json.Marshal(value)
+			return string(encoded), err
+		},
+		"sha256": func(value string) string {
+			sum := sha256.Sum256([]byte(value))
+			return hex.EncodeToString(sum[:])
+		},
+		"list": func(values ...interface{}) []interface{} {
+			return values
+		},
+		"split": func(value string, separator string) []string {
+			return strings.Split(value, separator)
+		},
+		"indent": func(spaces int, value string) string {
+			padding := strings.Repeat(" ", spaces)
+			return padding + strings.Replace(value, "\n", "\n"+padding, -1)
+		},
+	}
+
+	tmpl, err := template.New(filename).Funcs(funcs).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, templateData{Vars: config.Conf.Variables}); err != nil {
+		return nil, err
+	}
+	return rendered.Bytes(), nil
+}
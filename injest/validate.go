@@ -0,0 +1,282 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	yaml3 "gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ruleProblem is a problem found in the rules by validate
+type ruleProblem struct {
+	source  ruleSource
+	message string
+}
+
+func (problem ruleProblem) String() string {
+	return fmt.Sprintf("%s: %s", problem.source, problem.message)
+}
+
+// aclTypes are the types of legacy ACLs
+var aclTypes = map[string]bool{"": true, "client": true, "management": true}
+
+var strictErrorPattern = regexp.MustCompile(`^line (\d+): (.*)$`)
+var unknownFieldPattern = regexp.MustCompile(`field (\S+) not found in type \S+`)
+
+// ValidateRules checks every rule file of the paths without connecting to
+// Consul, and returns all the problems found
+func ValidateRules(paths []string) ([]string, error) {
+	problems := []ruleProblem{}
+	for _, path := range paths {
+		files := []string{path}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			root, _ := filepath.Abs(path)
+			if files, err = ruleFiles(root); err != nil {
+				return nil, err
+			}
+		}
+
+		// Conflicts are only detected between the files of the same layer.
+		// A file which can't be parsed has nothing more to report when loaded.
+		layer := consulConfig{Policies: acls{}, KeyValue: make(map[string]interface{})}
+		for _, file := range files {
+			fileProblems, parsed := validateFile(file)
+			if parsed {
+				if err := loadFile(file, &layer); err != nil {
+					// Most load errors already start with the file
+					message := strings.TrimPrefix(err.Error(), file+": ")
+					fileProblems = append(fileProblems, ruleProblem{source: ruleSource{file: file}, message: message})
+				}
+			}
+			problems = append(problems, fileProblems...)
+		}
+	}
+
+	result := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		result = append(result, problem.String())
+	}
+	return result, nil
+}
+
+// validateFile strictly decodes a rule file and checks its keys and ACLs.
+// Returns false if the file can't be parsed at all.
+func validateFile(filename string) ([]ruleProblem, bool) {
+	data, converted, err := readRules(filename)
+	if err != nil {
+		return []ruleProblem{{source: ruleSource{file: filename}, message: err.Error()}}, false
+	}
+
+	problems := []ruleProblem{}
+	at := func(line int) ruleSource {
+		if converted {
+			line = 0
+		}
+		return ruleSource{file: describeRules(filename), line: line}
+	}
+
+	var rules consulConfig
+	if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return []ruleProblem{{source: at(0), message: err.Error()}}, false
+		}
+		for _, message := range typeErr.Errors {
+			line := 0
+			if match := strictErrorPattern.FindStringSubmatch(message); match != nil {
+				line, _ = strconv.Atoi(match[1])
+				message = match[2]
+			}
+			message = unknownFieldPattern.ReplaceAllString(message, "unknown field '$1'")
+			problems = append(problems, ruleProblem{source: at(line), message: message})
+		}
+	}
+
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(data, &doc); err != nil {
+		return append(problems, ruleProblem{source: at(0), message: err.Error()}), false
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml3.MappingNode {
+		return problems, true
+	}
+
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		section, value := root.Content[i].Value, root.Content[i+1]
+		switch section {
+		case "kv":
+			if value.Kind == yaml3.MappingNode {
+				problems = append(problems, validateTree(value, "", at)...)
+			}
+		case "policies":
+			for _, entry := range value.Content {
+				if nodeField(entry, "name") == "" {
+					problems = append(problems, ruleProblem{source: at(entry.Line), message: "ACL without a name"})
+				}
+				if aclType := nodeField(entry, "type"); !aclTypes[aclType] {
+					problems = append(problems, ruleProblem{source: at(entry.Line), message: fmt.Sprintf("ACL '%s' has type '%s'. Expected 'client' or 'management'", nodeField(entry, "name"), aclType)})
+				}
+				problems = append(problems, validateAclRules(entry, at)...)
+			}
+		case "acl_policies", "acl_roles":
+			for _, entry := range value.Content {
+				if nodeField(entry, "name") == "" {
+					problems = append(problems, ruleProblem{source: at(entry.Line), message: fmt.Sprintf("Entry of %s without a name", section)})
+				}
+				if section == "acl_policies" {
+					problems = append(problems, validateAclRules(entry, at)...)
+				}
+			}
+		case "acl_tokens":
+			for _, entry := range value.Content {
+				if nodeField(entry, "description") == "" && nodeField(entry, "accessor_id") == "" {
+					problems = append(problems, ruleProblem{source: at(entry.Line), message: "ACL token without a description or an accessor_id"})
+				}
+			}
+		case "services":
+			for _, entry := range value.Content {
+				var declared service
+				if err := entry.Decode(&declared); err != nil || strings.Contains(nodeField(entry, "name"), "${") {
+					continue
+				}
+				if err := declared.validate(); err != nil {
+					problems = append(problems, ruleProblem{source: at(entry.Line), message: err.Error()})
+				}
+			}
+		}
+	}
+	return problems, true
+}
+
+// validateAclRules parses the rules of an ACL or ACL policy. Rules with
+// variables or file references are checked when they are planned.
+func validateAclRules(entry *yaml3.Node, at func(line int) ruleSource) []ruleProblem {
+	rules := nodeField(entry, "rules")
+	if strings.Contains(rules, "${") {
+		return nil
+	}
+	if _, err := canonicalRules(rules); err != nil {
+		return []ruleProblem{{source: at(entry.Line), message: fmt.Sprintf("Rules of '%s': %v", nodeField(entry, "name"), err)}}
+	}
+	return nil
+}
+
+// validateTree checks the keys of a KV tree. Top level trees end with a '/',
+// nested trees are declared without it.
+func validateTree(tree *yaml3.Node, path string, at func(line int) ruleSource) []ruleProblem {
+	problems := []ruleProblem{}
+	topLevel := path == ""
+	for i := 0; i+1 < len(tree.Content); i += 2 {
+		keyNode, value := tree.Content[i], tree.Content[i+1]
+		key := path + keyNode.Value
+		problem := func(format string, args ...interface{}) {
+			problems = append(problems, ruleProblem{source: at(keyNode.Line), message: fmt.Sprintf(format, args...)})
+		}
+
+		switch {
+		case keyNode.Value == "" && (topLevel || value.Kind != yaml3.ScalarNode || value.Value != ""):
+			problem("Empty key in the tree '%s'", path)
+			continue
+		case strings.HasPrefix(key, "/"):
+			problem("Key '%s' starts with a '/'", key)
+		case strings.Contains(key, "//"):
+			problem("Key '%s' contains an empty path segment", key)
+		}
+
+		if wrapper := valueMapping(value); wrapper != "" {
+			for j := 0; j < len(value.Content); j += 2 {
+				if !isValueKey(value.Content[j].Value) {
+					problem("Key '%s' has other keys next to '%s'", key, wrapper)
+					break
+				}
+			}
+			continue
+		}
+
+		switch value.Kind {
+		case yaml3.MappingNode:
+			if topLevel && !strings.HasSuffix(key, "/") {
+				problem("Tree '%s' must end with a '/'", key)
+				continue
+			}
+			if !topLevel && strings.HasSuffix(key, "/") {
+				problem("Nested tree '%s' must not end with a '/'", key)
+				continue
+			}
+			if !topLevel {
+				key += "/"
+			}
+			problems = append(problems, validateTree(value, key, at)...)
+		case yaml3.SequenceNode:
+			problem("Key '%s' has a list value", key)
+		case yaml3.ScalarNode:
+			if topLevel && strings.HasSuffix(key, "/") && !isTreeMarker(value.Value) {
+				problem("Tree '%s' has the value '%s'. Expected a tree, '', '${ignore}', '${delete}' or '${dir:path}'", key, value.Value)
+			}
+			if !topLevel && !isString(value) {
+				problem("Key '%s' has the non-string value '%s'. Quote it", key, value.Value)
+			}
+		}
+	}
+	return problems
+}
+
+// valueMapping returns the first key of a map which declares a single value
+// instead of a tree (like ${json}), or an empty string
+func valueMapping(node *yaml3.Node) string {
+	if node.Kind != yaml3.MappingNode {
+		return ""
+	}
+	for i := 0; i < len(node.Content); i += 2 {
+		if isValueKey(node.Content[i].Value) {
+			return node.Content[i].Value
+		}
+	}
+	return ""
+}
+
+// isString reports whether a scalar is decoded as a string. Plain scalars are
+// decoded with yaml.v2 like the rules, as YAML 1.1 has more non-strings.
+func isString(node *yaml3.Node) bool {
+	if node.Style&yaml3.TaggedStyle != 0 {
+		return node.Tag == "!!str" || node.Tag == "!!binary"
+	}
+	if node.Style != 0 {
+		return true
+	}
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(node.Value), &value); err != nil {
+		return true
+	}
+	_, ok := value.(string)
+	return ok
+}
+
+// isTreeMarker reports whether a string value is allowed for a tree
+func isTreeMarker(value string) bool {
+	return value == "" || value == "${ignore}" || value == deleteValue || dirReference.MatchString(value)
+}
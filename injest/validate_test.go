@@ -0,0 +1,124 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2consul/log"
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	Convey("Validating rules", t, func() {
+		Convey("Valid rules have no problems", func() {
+			dir := writeRules(map[string]string{
+				"kv.yml":     "kv:\n  top: level\n  app/:\n    db:\n      host: localhost\n    folder:\n      \"\": \"\"\n  legacy/: ${ignore}\n",
+				"acls.yml":   "policies:\n  - name: app\n    type: client\nacl_tokens:\n  - description: app\n",
+				"ignore.yml": "ignore:\n  kv: [\"cache/*\"]\n  acls: [\"Vault *\"]\n  tokens: [\"regex:^ci-\"]\n",
+			})
+			defer os.RemoveAll(dir)
+
+			problems, err := ValidateRules([]string{dir})
+			So(err, ShouldBeNil)
+			So(problems, ShouldBeEmpty)
+		})
+
+		Convey("Invalid ignore patterns are reported", func() {
+			dir := writeRules(map[string]string{"ignore.yml": "ignore:\n  kv: [\"regex:(\"]\n"})
+			defer os.RemoveAll(dir)
+
+			problems, err := ValidateRules([]string{dir})
+			So(err, ShouldBeNil)
+			So(problems, ShouldHaveLength, 1)
+			So(problems[0], ShouldContainSubstring, "Invalid ignore pattern 'regex:('")
+		})
+
+		Convey("Every problem is reported with its file and line", func() {
+			dir := writeRules(map[string]string{
+				"rules.yml": `polices:
+  - name: typo
+kv:
+  /leading: value
+  tree:
+    key: value
+  list: [a, b]
+  app/:
+    nested/:
+      key: value
+    "": value
+  bad/: value
+policies:
+  - name: app
+    type: admin
+    ruls: typo
+`,
+			})
+			defer os.RemoveAll(dir)
+
+			problems, err := ValidateRules([]string{dir})
+			So(err, ShouldBeNil)
+			file := filepath.Join(dir, "rules.yml")
+			So(problems, ShouldContain, file+":1: unknown field 'polices'")
+			So(problems, ShouldContain, file+":16: unknown field 'ruls'")
+			So(problems, ShouldContain, file+":4: Key '/leading' starts with a '/'")
+			So(problems, ShouldContain, file+":5: Tree 'tree' must end with a '/'")
+			So(problems, ShouldContain, file+":7: Key 'list' has a list value")
+			So(problems, ShouldContain, file+":9: Nested tree 'app/nested/' must not end with a '/'")
+			So(problems, ShouldContain, file+":11: Empty key in the tree 'app/'")
+			So(problems, ShouldContain, file+":12: Tree 'bad/' has the value 'value'. Expected a tree, '', '${ignore}', '${delete}' or '${dir:path}'")
+			So(problems, ShouldContain, file+":14: ACL 'app' has type 'admin'. Expected 'client' or 'management'")
+			So(len(problems), ShouldEqual, 10)
+			So(problems[9], ShouldStartWith, file+": Unexpected value for the key ")
+		})
+
+		Convey("Load problems are reported along with the other problems", func() {
+			dir := writeRules(map[string]string{
+				"a.yml": "kv:\n  key: one\n",
+				"b.yml": "kv:\n  key: two\nunknown: x\n",
+				"c.yml": "kv:\n  app/:\n    port: 8080\n    enabled: yes\n    name: \"8080\"\n",
+			})
+			defer os.RemoveAll(dir)
+
+			problems, err := ValidateRules([]string{dir})
+			So(err, ShouldBeNil)
+			b, c := filepath.Join(dir, "b.yml"), filepath.Join(dir, "c.yml")
+			So(problems, ShouldContain, b+":3: unknown field 'unknown'")
+			So(problems, ShouldContain, c+":3: Key 'app/port' has the non-string value '8080'. Quote it")
+			So(problems, ShouldContain, c+":4: Key 'app/enabled' has the non-string value 'yes'. Quote it")
+			So(len(problems), ShouldEqual, 5)
+			So(problems[1], ShouldContainSubstring, "key 'key' is defined in both")
+			So(problems[4], ShouldStartWith, c+": Unexpected value for the key tree")
+		})
+
+		Convey("Conflicts between files are reported", func() {
+			dir := writeRules(map[string]string{
+				"a.yml": "kv:\n  key: one\n",
+				"b.yml": "kv:\n  key: two\n",
+			})
+			defer os.RemoveAll(dir)
+
+			problems, err := ValidateRules([]string{dir})
+			So(err, ShouldBeNil)
+			So(len(problems), ShouldEqual, 1)
+			So(problems[0], ShouldContainSubstring, "key 'key' is defined in both")
+		})
+	})
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2consul/config"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// variablePattern matches ${var.name} and ${env.NAME}, with an optional
+// default value: ${var.name:-default}. A variable escaped as $${var.name} is
+// matched with the escape, to be left as it is.
+var variablePattern = regexp.MustCompile(`\$?\$\{(var|env)\.([A-Za-z0-9_\-]+)(:-[^}]*)?\}`)
+
+// escapePrefix writes a literal "${" in the rules
+const escapePrefix = "$${"
+
+// resolveVariables replaces the variables in every string of the rules of a
+// file, including the keys of the KV trees. Any variable without a value is
+// an error naming the file and the key. File, directory and base64 references
+// are only read in the KV trees, after the variables in them are replaced.
+func resolveVariables(rules *consulConfig, filename string) error {
+	keyValue := rules.KeyValue
+	rules.KeyValue = nil
+	err := resolveValue(reflect.ValueOf(rules).Elem(), filename, "", false)
+	rules.KeyValue = keyValue
+	if err != nil {
+		return err
+	}
+	return resolveValue(reflect.ValueOf(&rules.KeyValue).Elem(), filename, "kv", true)
+}
+
+func resolveValue(value reflect.Value, filename string, where string, references bool) error {
+	switch value.Kind() {
+	case reflect.String:
+		resolved, err := resolveString(value.String(), filename, where)
+		if err != nil {
+			return err
+		}
+		switch {
+		case references && fileReference.MatchString(resolved):
+			if resolved, err = readFileReference(resolved, filename, where); err != nil {
+				return err
+			}
+			if resolved, err = decodeBase64Reference(resolved, filename, where); err != nil {
+				return err
+			}
+		case references && base64Reference.MatchString(resolved):
+			if resolved, err = decodeBase64Reference(resolved, filename, where); err != nil {
+				return err
+			}
+		default:
+			resolved = unescape(resolved)
+		}
+		value.SetString(resolved)
+	case reflect.Ptr:
+		if !value.IsNil() {
+			return resolveValue(value.Elem(), filename, where, references)
+		}
+	case reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+		// The value inside an interface isn't settable, so resolve a copy
+		inner := reflect.New(value.Elem().Type()).Elem()
+		inner.Set(value.Elem())
+		if err := resolveValue(inner, filename, where, references); err != nil {
+			return err
+		}
+		value.Set(inner)
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "" {
+				name = field.Name
+			}
+			if where != "" {
+				name = where + "." + name
+			}
+			if err := resolveValue(value.Field(i), filename, name, references); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			if err := resolveValue(value.Index(i), filename, fmt.Sprintf("%s[%d]", where, i), references); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// The resolved keys, to detect two keys resolving to the same key
+		resolvedKeys := make(map[string]string)
+		for _, key := range value.MapKeys() {
+			path := fmt.Sprintf("%s[%q]", where, fmt.Sprint(key.Interface()))
+			item := reflect.New(value.Type().Elem()).Elem()
+			item.Set(value.MapIndex(key))
+
+			tree, mirrored, err := resolveDirReference(item, filename, path, references)
+			if err != nil {
+				return err
+			}
+			if mirrored {
+				item.Set(reflect.ValueOf(tree))
+			} else if err := resolveValue(item, filename, path, references); err != nil {
+				return err
+			}
+
+			newKey := key
+			if name, ok := key.Interface().(string); ok {
+				resolved, err := resolveString(name, filename, path)
+				if err != nil {
+					return err
+				}
+				resolved = unescape(resolved)
+				if other, ok := resolvedKeys[resolved]; ok {
+					return fmt.Errorf("Keys %q and %q of %s in %s both resolve to %q", other, name, where, filename, resolved)
+				}
+				resolvedKeys[resolved] = name
+				if resolved != name {
+					value.SetMapIndex(key, reflect.Value{})
+					newKey = reflect.ValueOf(resolved).Convert(value.Type().Key())
+				}
+			}
+			value.SetMapIndex(newKey, item)
+		}
+	}
+	return nil
+}
+
+// resolveDirReference returns the tree mirroring a directory if the item is
+// a ${dir:path} reference once its variables are replaced
+func resolveDirReference(item reflect.Value, filename string, where string, references bool) (map[interface{}]interface{}, bool, error) {
+	if !references || item.Kind() != reflect.Interface {
+		return nil, false, nil
+	}
+	reference, ok := item.Interface().(string)
+	if !ok {
+		return nil, false, nil
+	}
+	resolved, err := resolveString(reference, filename, where)
+	if err != nil {
+		return nil, false, err
+	}
+	return readDirReference(resolved, filename, where)
+}
+
+// unescape turns the escaped $${ into a literal ${
+func unescape(value string) string {
+	return strings.ReplaceAll(value, escapePrefix, "${")
+}
+
+// escape protects every ${ of a value from being resolved when the rules are
+// loaded
+func escape(value string) string {
+	return strings.ReplaceAll(value, "${", escapePrefix)
+}
+
+// escapeStrings escapes every string of exported rules, so they are loaded
+// back as they are
+func escapeStrings(value reflect.Value) {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(escape(value.String()))
+	case reflect.Ptr:
+		if !value.IsNil() {
+			escapeStrings(value.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if value.Type().Field(i).PkgPath == "" {
+				escapeStrings(value.Field(i))
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			escapeStrings(value.Index(i))
+		}
+	}
+}
+
+// resolveString replaces the variables in a value. Variables come from the
+// config (-var and -var-file) and environment variables. The escaped variables
+// are left for unescape.
+func resolveString(value string, filename string, where string) (string, error) {
+	missing := []string{}
+	resolved := variablePattern.ReplaceAllStringFunc(value, func(match string) string {
+		if strings.HasPrefix(match, escapePrefix) {
+			return match
+		}
+		parts := variablePattern.FindStringSubmatch(match)
+		kind, name, fallback := parts[1], parts[2], parts[3]
+
+		var result string
+		var ok bool
+		switch kind {
+		case "var":
+			result, ok = config.Conf.Variables[name]
+		case "env":
+			result, ok = os.LookupEnv(name)
+		}
+		if ok {
+			return result
+		}
+		if fallback != "" {
+			return strings.TrimPrefix(fallback, ":-")
+		}
+		missing = append(missing, kind+"."+name)
+		return match
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("Unresolved variable %s in %s at %s", strings.Join(missing, ", "), filename, where)
+	}
+	return resolved, nil
+}
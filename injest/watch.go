@@ -0,0 +1,322 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2consul/config"
+	"config2consul/log"
+	"context"
+	"encoding/binary"
+	"fmt"
+	consulapi "github.com/hashicorp/consul/api"
+	"hash/fnv"
+	"io"
+	"time"
+)
+
+// Watch modes. converge writes the rules back to Consul, report only writes a
+// drift report.
+const (
+	watchModeConverge = "converge"
+	watchModeReport   = "report"
+)
+
+const (
+	// watchWaitTime is how long a blocking query waits for a change
+	watchWaitTime = 5 * time.Minute
+	// settleTime batches the changes made together into a single reconciliation
+	settleTime = time.Second
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// watcher is a blocking query on a part of Consul managed by the rules. The
+// query returns the index of the last change and a digest of the watched
+// state. A new index with the same digest is not a change.
+type watcher struct {
+	name  string
+	query func(q *consulapi.QueryOptions) (uint64, uint64, error)
+}
+
+// Watch keeps Consul converged to the rules until stop is closed. Every
+// deviation is either converged or reported to out, depending on the
+// watch_mode in the config file.
+func Watch(consConf *consulConfig, out io.Writer, stop <-chan struct{}) error {
+	consul := create(&config.Conf)
+	err := consul.watch(consConf, out, stop)
+	consul.Client = nil
+	return err
+}
+
+func (consul *consulClient) watch(consConf *consulConfig, out io.Writer, stop <-chan struct{}) error {
+	mode := config.Conf.WatchMode
+	if mode == "" {
+		mode = watchModeConverge
+	}
+	if mode != watchModeConverge && mode != watchModeReport {
+		return fmt.Errorf("Unknown watch mode '%s'. Expected '%s' or '%s'", mode, watchModeConverge, watchModeReport)
+	}
+	log.Infof("Watching Consul for changes in %s mode", mode)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A single pending event is enough to trigger a reconciliation
+	events := make(chan string, 1)
+	for _, w := range consul.watchers(consConf) {
+		go consul.runWatcher(ctx, w, events)
+	}
+
+	// retryAt is when the retry of a failed reconciliation is due, zero if
+	// the last reconciliation succeeded
+	backoff := time.Duration(0)
+	retryAt := time.Time{}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			log.Info("Stopping the watch")
+			return nil
+		case name := <-events:
+			log.Debugf("Change detected in %s", name)
+			resetTimer(timer, settleDelay(retryAt, time.Now()))
+		case <-timer.C:
+			if err := consul.reconcile(consConf, mode, out, stop); err != nil {
+				backoff = nextBackoff(backoff)
+				retryAt = time.Now().Add(backoff)
+				log.Errorf("Reconciliation failed, retrying in %s. %v", backoff, err)
+				timer.Reset(backoff)
+			} else {
+				backoff = 0
+				retryAt = time.Time{}
+			}
+		}
+	}
+}
+
+// reconcile plans the rules and converges or reports the deviations. Closing
+// stop gives up waiting for the lock.
+func (consul *consulClient) reconcile(consConf *consulConfig, mode string, out io.Writer, stop <-chan struct{}) error {
+	if mode == watchModeReport {
+		changes, err := consul.planConfig(consConf)
+		if err != nil {
+			return err
+		}
+		if !changes.HasChanges() {
+			log.Debug("Consul matches the rules")
+			return nil
+		}
+		log.Warning("Consul deviates from the rules")
+		return changes.DriftReport(config.Conf.Address).Write(out)
+	}
+
+	return consul.withLock(stop, func() error {
+		changes, err := consul.planConfig(consConf)
+		if err != nil {
+			return err
+		}
+		if !changes.HasChanges() {
+			log.Debug("Consul matches the rules")
+			return nil
+		}
+		log.Warning("Consul deviates from the rules. Converging ...")
+		if err := changes.checkDeleteLimits(); err != nil {
+			return err
+		}
+		return consul.applyPlan(changes)
+	})
+}
+
+// watchers returns the blocking queries for the parts of Consul the rules
+// manage. Like planConfig, a part is only watched if the rules declare it.
+func (consul *consulClient) watchers(consConf *consulConfig) []watcher {
+	watchers := []watcher{}
+
+	if len(consConf.KeyValue) > 0 {
+		for _, prefix := range consConf.managedScope() {
+			prefix := prefix
+			watchers = append(watchers, watcher{
+				name: fmt.Sprintf("keys with prefix '%s'", prefix),
+				query: func(q *consulapi.QueryOptions) (uint64, uint64, error) {
+					pairs, meta, err := consul.Client.KV().List(prefix, q)
+					if err != nil {
+						return 0, 0, err
+					}
+					return meta.LastIndex, kvDigest(pairs, lockKey()), nil
+				},
+			})
+		}
+	}
+	if len(consConf.Policies) > 0 {
+		watchers = append(watchers, watcher{
+			name: "ACLs",
+			query: func(q *consulapi.QueryOptions) (uint64, uint64, error) {
+				_, meta, err := consul.Client.ACL().List(q)
+				return lastIndex(meta, err)
+			},
+		})
+	}
+	if len(consConf.AclPolicies) > 0 {
+		watchers = append(watchers, watcher{
+			name: "ACL policies",
+			query: func(q *consulapi.QueryOptions) (uint64, uint64, error) {
+				_, meta, err := consul.Client.ACL().PolicyList(q)
+				return lastIndex(meta, err)
+			},
+		})
+	}
+	if len(consConf.AclRoles) > 0 {
+		watchers = append(watchers, watcher{
+			name: "ACL roles",
+			query: func(q *consulapi.QueryOptions) (uint64, uint64, error) {
+				_, meta, err := consul.Client.ACL().RoleList(q)
+				return lastIndex(meta, err)
+			},
+		})
+	}
+	if len(consConf.Services) > 0 {
+		watchers = append(watchers, watcher{
+			name: "services",
+			query: func(q *consulapi.QueryOptions) (uint64, uint64, error) {
+				_, meta, err := consul.Client.Catalog().Services(q)
+				return lastIndex(meta, err)
+			},
+		})
+	}
+	if len(consConf.AclTokens) > 0 {
+		watchers = append(watchers, watcher{
+			name: "ACL tokens",
+			query: func(q *consulapi.QueryOptions) (uint64, uint64, error) {
+				_, meta, err := consul.Client.ACL().TokenList(q)
+				return lastIndex(meta, err)
+			},
+		})
+	}
+
+	return watchers
+}
+
+// lastIndex returns the index of a query as both the index and the digest
+func lastIndex(meta *consulapi.QueryMeta, err error) (uint64, uint64, error) {
+	if err != nil {
+		return 0, 0, err
+	}
+	return meta.LastIndex, meta.LastIndex, nil
+}
+
+// kvDigest summarizes the keys and their modify indexes. The lock is left
+// out, as every reconciliation in converge mode acquires and releases it,
+// which would otherwise trigger the next reconciliation.
+func kvDigest(pairs consulapi.KVPairs, lock string) uint64 {
+	hash := fnv.New64a()
+	index := make([]byte, 8)
+	for _, kv := range pairs {
+		if kv.Key == lock {
+			continue
+		}
+		binary.BigEndian.PutUint64(index, kv.ModifyIndex)
+		hash.Write([]byte(kv.Key))
+		hash.Write([]byte{0})
+		hash.Write(index)
+	}
+	return hash.Sum64()
+}
+
+// runWatcher repeats the blocking query until ctx is canceled and sends the
+// name of the watcher to events on every change
+func (consul *consulClient) runWatcher(ctx context.Context, w watcher, events chan<- string) {
+	var index, digest uint64
+	backoff := time.Duration(0)
+	for {
+		q := (&consulapi.QueryOptions{WaitIndex: index, WaitTime: watchWaitTime}).WithContext(ctx)
+		last, state, err := w.query(q)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			backoff = nextBackoff(backoff)
+			log.Warningf("Watching %s failed, retrying in %s. %v", w.name, backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+
+		changed, next := nextIndex(index, last)
+		if changed && state == digest {
+			log.Debugf("Ignoring an index change in %s which changed nothing watched", w.name)
+			changed = false
+		}
+		if changed {
+			select {
+			case events <- w.name:
+			default:
+			}
+		}
+		index, digest = next, state
+	}
+}
+
+// nextIndex returns whether a blocking query result is a change and the index
+// to wait on next. The first query only establishes the index. An index going
+// backwards (e.g. after a snapshot restore) restarts the wait from scratch.
+func nextIndex(index uint64, last uint64) (bool, uint64) {
+	switch {
+	case index == 0:
+		return false, last
+	case last < index:
+		return true, 0
+	default:
+		return last != index, last
+	}
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return minBackoff
+	}
+	backoff *= 2
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// settleDelay is how long to wait after a change before reconciling. A
+// change doesn't bring a pending retry forward, so a failing Consul isn't
+// hammered by every change it reports.
+func settleDelay(retryAt time.Time, now time.Time) time.Duration {
+	if remaining := retryAt.Sub(now); remaining > settleTime {
+		return remaining
+	}
+	return settleTime
+}
+
+// resetTimer resets a timer which may have fired without being drained
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
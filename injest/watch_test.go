@@ -0,0 +1,168 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2consul/config"
+	"config2consul/log"
+	"fmt"
+	consulapi "github.com/hashicorp/consul/api"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+
+	Convey("Blocking query indexes", t, func() {
+		Convey("The first query only establishes the index", func() {
+			changed, next := nextIndex(0, 42)
+			So(changed, ShouldBeFalse)
+			So(next, ShouldEqual, 42)
+		})
+
+		Convey("A timed out query is not a change", func() {
+			changed, next := nextIndex(42, 42)
+			So(changed, ShouldBeFalse)
+			So(next, ShouldEqual, 42)
+		})
+
+		Convey("A newer index is a change", func() {
+			changed, next := nextIndex(42, 50)
+			So(changed, ShouldBeTrue)
+			So(next, ShouldEqual, 50)
+		})
+
+		Convey("An index going backwards is a change and restarts the wait", func() {
+			changed, next := nextIndex(42, 7)
+			So(changed, ShouldBeTrue)
+			So(next, ShouldEqual, 0)
+		})
+	})
+
+	Convey("KV digests", t, func() {
+		pairs := func(lockIndex uint64, session string) consulapi.KVPairs {
+			return consulapi.KVPairs{
+				{Key: "app/db", ModifyIndex: 10},
+				{Key: "config2consul/lock", ModifyIndex: lockIndex, Session: session},
+				{Key: "config2consul/other", ModifyIndex: 12},
+			}
+		}
+		digest := kvDigest(pairs(11, ""), "config2consul/lock")
+
+		Convey("Acquiring and releasing the lock changes nothing watched", func() {
+			So(kvDigest(pairs(20, "session"), "config2consul/lock"), ShouldEqual, digest)
+			So(kvDigest(pairs(21, ""), "config2consul/lock"), ShouldEqual, digest)
+		})
+
+		Convey("Modifying a key is a change", func() {
+			modified := pairs(11, "")
+			modified[0].ModifyIndex = 22
+			So(kvDigest(modified, "config2consul/lock"), ShouldNotEqual, digest)
+		})
+
+		Convey("Deleting a key is a change", func() {
+			So(kvDigest(pairs(11, "")[:2], "config2consul/lock"), ShouldNotEqual, digest)
+		})
+	})
+
+	Convey("Only the parts of Consul declared by the rules are watched", t, func() {
+		consul := consulClient{}
+		names := func(rules *consulConfig) []string {
+			result := []string{}
+			for _, w := range consul.watchers(rules) {
+				result = append(result, w.name)
+			}
+			return result
+		}
+
+		So(names(&consulConfig{Policies: acls{}, KeyValue: map[string]interface{}{}}), ShouldBeEmpty)
+		So(names(&consulConfig{
+			Policies:  acls{{Name: "app"}},
+			KeyValue:  map[string]interface{}{"app/": map[string]interface{}{"db": "x"}},
+			AclTokens: []aclToken{{Description: "app token"}},
+		}), ShouldResemble, []string{"keys with prefix ''", "ACLs", "ACL tokens"})
+	})
+
+	Convey("Backoff doubles up to the maximum", t, func() {
+		So(nextBackoff(0), ShouldEqual, minBackoff)
+		So(nextBackoff(minBackoff), ShouldEqual, 2*minBackoff)
+		So(nextBackoff(maxBackoff), ShouldEqual, maxBackoff)
+		So(nextBackoff(40*time.Second), ShouldEqual, maxBackoff)
+	})
+
+	Convey("A change doesn't bring a pending retry forward", t, func() {
+		now := time.Now()
+		So(settleDelay(time.Time{}, now), ShouldEqual, settleTime)
+		So(settleDelay(now.Add(30*time.Second), now), ShouldEqual, 30*time.Second)
+		So(settleDelay(now.Add(settleTime/2), now), ShouldEqual, settleTime)
+		So(settleDelay(now.Add(-time.Second), now), ShouldEqual, settleTime)
+	})
+}
+
+func TestLockWait(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+
+	Convey("Waiting for the lock", t, func() {
+		// Another session holds the lock, every blocking query returns it again
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/v1/session/create":
+				w.Write([]byte(`{"ID": "mine"}`))
+			case r.URL.Path == "/v1/kv/"+defaultLockKey:
+				time.Sleep(10 * time.Millisecond)
+				w.Header().Set("X-Consul-Index", "42")
+				fmt.Fprintf(w, `[{"Key": "%s", "Flags": %d, "Session": "other"}]`, defaultLockKey, consulapi.LockFlagValue)
+			case strings.HasPrefix(r.URL.Path, "/v1/session/"):
+				w.Write([]byte(`[]`))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		defer server.Close()
+		client, err := consulapi.NewClient(&consulapi.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+		So(err, ShouldBeNil)
+		consul := consulClient{Client: client}
+
+		defer func() { config.Conf = config.Config{} }()
+		config.Conf.LockWait = true
+
+		Convey("Closing stop gives up waiting and skips converge", func() {
+			stop := make(chan struct{})
+			time.AfterFunc(50*time.Millisecond, func() { close(stop) })
+			converged := false
+			done := make(chan error, 1)
+			go func() {
+				done <- consul.withLock(stop, func() error {
+					converged = true
+					return nil
+				})
+			}()
+
+			select {
+			case err := <-done:
+				So(err, ShouldBeNil)
+				So(converged, ShouldBeFalse)
+			case <-time.After(5 * time.Second):
+				So("withLock kept waiting after stop was closed", ShouldBeEmpty)
+			}
+		})
+	})
+}